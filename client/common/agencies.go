@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AgenciesAuto List of agencies that runs every agency with a bets file
+const AgenciesAuto = "auto"
+
+// ParseAgencies Returns the IDs of a list of agencies such as "1,3,5-8",
+// in order and without repetitions. With AgenciesAuto the agencies are
+// the ones with a bets file in DirDataPath, or in the zip archive of
+// Input, named as in FileDataName
+func ParseAgencies(list string, config ClientConfig) ([]int, error) {
+	if strings.TrimSpace(list) == AgenciesAuto {
+		return discoverAgencies(config)
+	}
+
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		first, last := item, item
+		if dash := strings.Index(item, "-"); dash >= 0 {
+			first, last = item[:dash], item[dash+1:]
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid agency %q in %q", item, list)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil || to < from || from < 1 {
+			return nil, fmt.Errorf("invalid agency %q in %q", item, list)
+		}
+		for id := from; id <= to; id++ {
+			seen[id] = true
+		}
+	}
+	return sortedIDs(seen), nil
+}
+
+// discoverAgencies Returns the agencies with a bets file in DirDataPath,
+// or in Input if it is a zip archive
+func discoverAgencies(config ClientConfig) ([]int, error) {
+	if IsArchive(config.Input) {
+		seen, err := archiveAgencies(config.Input, config.FileDataName)
+		if err != nil {
+			return nil, err
+		}
+		if len(seen) == 0 {
+			return nil, fmt.Errorf("no bets files named %s*.csv in %s", config.FileDataName, config.Input)
+		}
+		return sortedIDs(seen), nil
+	}
+
+	pattern := filepath.Join(config.DirDataPath, config.FileDataName+"*.csv")
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), config.FileDataName), ".csv")
+		if id, err := strconv.Atoi(name); err == nil && id > 0 {
+			seen[id] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("no bets files match %s", pattern)
+	}
+	return sortedIDs(seen), nil
+}
+
+// sortedIDs Returns the IDs of the set in order
+func sortedIDs(set map[int]bool) []int {
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// RunAgencies Runs the client loop of every agency concurrently, at most
+// concurrency of them uploading their bets at once (all if 0). Agencies
+// waiting for the draw do not count, as the draw needs every agency to
+// finish its upload. Every agency uses the config
+// with its own ID and its secret of AuthSecrets, and its logs are tagged with an agency field. If
+// multiplex is set the agencies talk through a single connection (see
+// Mux), otherwise every agency opens its own
+// Returns the error of every agency, nil for the ones that finished
+func RunAgencies(ctx context.Context, config ClientConfig, ids []int, concurrency int, multiplex bool) map[int]error {
+	results := make(map[int]error, len(ids))
+	logger := loggerOf(config)
+
+	var mux *Mux
+	if multiplex {
+		var err error
+		mux, err = DialMux(ctx, config)
+		if err != nil {
+			logger.Errorf("action: connect | result: fail | client_id: %v | error: %v",
+				config.ID,
+				err,
+			)
+			for _, id := range ids {
+				results[id] = err
+			}
+			return results
+		}
+		defer mux.Close()
+	}
+
+	if concurrency <= 0 || concurrency > len(ids) {
+		concurrency = len(ids)
+	}
+	slots := make(chan struct{}, concurrency)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		agencyConfig := config
+		agencyConfig.ID = id
+		if secret, ok := config.AuthSecrets[id]; ok {
+			agencyConfig.AuthSecret = secret
+		}
+		agencyConfig.AuthSecrets = nil
+		agencyConfig.Logger = logger.WithField("agency", id)
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			// Agencies that did not start yet are not started
+			mutex.Lock()
+			results[id] = &Canceled{Err: ctx.Err()}
+			mutex.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(agencyConfig ClientConfig) {
+			defer wg.Done()
+			var release sync.Once
+			free := func() { <-slots }
+			defer release.Do(free)
+			err := runAgency(ctx, agencyConfig, mux, func() { release.Do(free) })
+			mutex.Lock()
+			results[agencyConfig.ID] = err
+			mutex.Unlock()
+		}(agencyConfig)
+	}
+	wg.Wait()
+	return results
+}
+
+// runAgency Runs the client loop of an agency, through the mux if it is
+// not nil. uploaded is called once its bets were uploaded
+func runAgency(ctx context.Context, config ClientConfig, mux *Mux, uploaded func()) error {
+	var client *Client
+	var err error
+	if mux != nil {
+		client, err = mux.NewClient(config)
+	} else {
+		client, err = NewClient(config)
+	}
+	if err != nil {
+		config.Logger.Errorf("action: create_client | result: fail | client_id: %v | error: %v",
+			config.ID,
+			err,
+		)
+		return err
+	}
+	client.on_uploaded = uploaded
+	return client.StartClientLoop(ctx)
+}
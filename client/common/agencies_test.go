@@ -0,0 +1,256 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+func TestParseAgencies(t *testing.T) {
+	cases := map[string][]int{
+		"1":          {1},
+		"3,1-2, 2":   {1, 2, 3},
+		" 5 - 7 ,1 ": {1, 5, 6, 7},
+	}
+	for list, want := range cases {
+		ids, err := ParseAgencies(list, ClientConfig{})
+		if err != nil {
+			t.Fatalf("%q: %v", list, err)
+		}
+		if !reflect.DeepEqual(ids, want) {
+			t.Fatalf("%q: got %v, want %v", list, ids, want)
+		}
+	}
+}
+
+func TestParseAgenciesRejectsInvalidLists(t *testing.T) {
+	for _, list := range []string{"", "a", "1,", "3-1", "0", "-1", "1-"} {
+		if ids, err := ParseAgencies(list, ClientConfig{}); err == nil {
+			t.Fatalf("%q: got %v, want an error", list, ids)
+		}
+	}
+}
+
+func TestParseAgenciesAuto(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"agency-4.csv", "agency-1.csv", "agency-x.csv", "agency-0.csv", "other-2.csv"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := ClientConfig{DirDataPath: dir, FileDataName: "agency-"}
+	ids, err := ParseAgencies(AgenciesAuto, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 4}) {
+		t.Fatalf("got %v, want [1 4]", ids)
+	}
+
+	config.DirDataPath = t.TempDir()
+	if ids, err := ParseAgencies(AgenciesAuto, config); err == nil {
+		t.Fatalf("got %v without bets files", ids)
+	}
+}
+
+func TestParseAgenciesAutoArchive(t *testing.T) {
+	archive := writeArchive(t, map[string]string{
+		"data/agency-3.csv": "",
+		"agency-2.csv":      "",
+		"data/readme.txt":   "",
+	})
+	ids, err := ParseAgencies(AgenciesAuto, ClientConfig{Input: archive, FileDataName: "agency-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{2, 3}) {
+		t.Fatalf("got %v, want [2 3]", ids)
+	}
+}
+
+func TestRunAgenciesLimitsConcurrentUploads(t *testing.T) {
+	const bets = 6
+	dir := t.TempDir()
+	for id := 1; id <= 4; id++ {
+		writeBetsFile(t, dir, id, bets)
+	}
+
+	// An agency uploads from its first chunk until the server stores its
+	// last bet, which happens before its last ack releases the slot
+	var mutex sync.Mutex
+	received := make(map[int]int)
+	uploading, maxUploading := 0, 0
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+		encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+		for {
+			msg, err := decoder.Decode()
+			if err != nil {
+				return
+			}
+			reply := &protocol.Response{Kind: protocol.ResponseDrawResult, Draw: &protocol.DrawResult{Winners: []int{}}}
+			if msg.Type == protocol.MsgBets {
+				mutex.Lock()
+				if received[msg.AgencyID] == 0 {
+					uploading++
+					if uploading > maxUploading {
+						maxUploading = uploading
+					}
+				}
+				received[msg.AgencyID] += len(msg.Bets)
+				if received[msg.AgencyID] == bets {
+					uploading--
+				}
+				mutex.Unlock()
+				time.Sleep(2 * time.Millisecond)
+				reply = &protocol.Response{Kind: protocol.ResponseBatchAck, Count: len(msg.Bets), Seq: msg.Seq}
+			}
+			if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: reply.String()}); err != nil {
+				return
+			}
+		}
+	}
+
+	config := uploadConfig(dir, nil, 1)
+	config.Transport = &PipeTransport{Serve: serve}
+	config.FileDataName = "agency-"
+	config.Logger = discardLogger()
+	results := RunAgencies(context.Background(), config, []int{1, 2, 3, 4}, 2, false)
+	for id := 1; id <= 4; id++ {
+		if err := results[id]; err != nil {
+			t.Fatalf("agency %d: %v", id, err)
+		}
+		if received[id] != bets {
+			t.Fatalf("agency %d: got %d bets, want %d", id, received[id], bets)
+		}
+	}
+	if maxUploading > 2 {
+		t.Fatalf("got %d agencies uploading at once, want at most 2", maxUploading)
+	}
+}
+
+func TestRunAgenciesReturnsTheErrorOfEveryAgency(t *testing.T) {
+	dir := t.TempDir()
+	writeBetsFile(t, dir, 1, 3)
+	writeBetsFile(t, dir, 3, 3)
+	server := newBetServer(nil)
+	config := uploadConfig(dir, server, 1)
+	config.FileDataName = "agency-"
+	config.Logger = discardLogger()
+
+	// Agency 2 has no bets file
+	results := RunAgencies(context.Background(), config, []int{1, 2, 3}, 0, false)
+	if len(results) != 3 {
+		t.Fatalf("got the results of %d agencies, want 3", len(results))
+	}
+	if results[1] != nil || results[3] != nil {
+		t.Fatalf("got errors %v and %v, want none", results[1], results[3])
+	}
+	if !errors.Is(results[2], os.ErrNotExist) {
+		t.Fatalf("got %v, want a missing file error", results[2])
+	}
+
+	// Agencies that did not start when ctx is done are canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = RunAgencies(ctx, config, []int{1, 3}, 1, false)
+	for _, id := range []int{1, 3} {
+		var canceled *Canceled
+		if !errors.As(results[id], &canceled) {
+			t.Fatalf("agency %d: got %v, want Canceled", id, results[id])
+		}
+	}
+}
+
+func TestRunAgenciesSignsWithTheSecretOfEveryAgency(t *testing.T) {
+	dir := t.TempDir()
+	for id := 1; id <= 2; id++ {
+		writeBetsFile(t, dir, id, 3)
+	}
+
+	// Multiplexed server that only accepts messages signed with the
+	// secret of their agency
+	verifier := protocol.NewVerifier(map[int][]byte{1: []byte("default"), 2: []byte("second")}, time.Minute)
+	helloAgency := -1
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+		encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+		hello, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+		helloAgency = hello.AgencyID
+		welcome := &protocol.Response{
+			Kind:    protocol.ResponseWelcome,
+			Welcome: &protocol.Welcome{Version: 1, Features: []string{protocol.FeatureAuth, protocol.FeatureMultiplex}},
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: welcome.String()}); err != nil {
+			return
+		}
+		for {
+			signed, err := decoder.Decode()
+			if err != nil {
+				return
+			}
+			var reply *protocol.Response
+			msg, err := verifier.Open(protocol.TextCodec{}, signed)
+			var authErr *protocol.AuthError
+			switch {
+			case errors.As(err, &authErr):
+				reply = &protocol.Response{Kind: protocol.ResponseError, Message: strings.TrimPrefix(authErr.Reply(), "ERROR: ")}
+			case err != nil:
+				return
+			case msg.Type == protocol.MsgBets:
+				reply = &protocol.Response{Kind: protocol.ResponseBatchAck, Count: len(msg.Bets), Seq: msg.Seq}
+			default:
+				reply = &protocol.Response{Kind: protocol.ResponseDrawResult, Draw: &protocol.DrawResult{Winners: []int{}}}
+			}
+			if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, AgencyID: signed.AgencyID, Text: reply.String()}); err != nil {
+				return
+			}
+		}
+	}
+
+	config := uploadConfig(dir, nil, 1)
+	config.Transport = &PipeTransport{Serve: serve}
+	config.FileDataName = "agency-"
+	config.Logger = discardLogger()
+	config.Handshake = true
+	config.AuthSecrets = map[int]string{2: "second"}
+	config.Reconnect = ReconnectConfig{}
+
+	// Without a secret of its own agency 1 uses the default one
+	config.AuthSecret = "default"
+	results := RunAgencies(context.Background(), config, []int{1, 2}, 0, true)
+	for id := 1; id <= 2; id++ {
+		if err := results[id]; err != nil {
+			t.Fatalf("agency %d: %v", id, err)
+		}
+	}
+	if helloAgency != muxAgencyID {
+		t.Fatalf("got handshake of agency %d, want %d", helloAgency, muxAgencyID)
+	}
+
+	// Only the agencies of AuthSecrets sign without a default secret
+	config.AuthSecret = ""
+	results = RunAgencies(context.Background(), config, []int{1, 2}, 0, true)
+	var rejected *ServerRejected
+	if !errors.As(results[1], &rejected) {
+		t.Fatalf("agency 1: got %v, want ServerRejected", results[1])
+	}
+	if results[2] != nil {
+		t.Fatalf("agency 2: %v", results[2])
+	}
+}
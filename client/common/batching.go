@@ -0,0 +1,129 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// batchSizer Decides how many bets go in the next chunk. Starting from
+// BetChunkSize, the number of bets grows by a quarter while the acks
+// arrive within BetTargetRTT and is halved when they do not (the size is
+// fixed if BetTargetRTT is 0), never beyond protocol.MaxBetsPerMessage.
+// Whatever the number of bets, a chunk never exceeds BetMaxBytes once
+// encoded as sent, compressed and signed (no limit if 0)
+type batchSizer struct {
+	maxBytes  int
+	targetRTT time.Duration
+	size      int
+}
+
+// newBatchSizer Initializes the sizer of the chunks of the config
+func newBatchSizer(config ClientConfig) *batchSizer {
+	return &batchSizer{
+		maxBytes:  config.BetMaxBytes,
+		targetRTT: config.BetTargetRTT,
+		size:      clampBatchSize(config.BetChunkSize),
+	}
+}
+
+// clampBatchSize Returns the closest number of bets a chunk may have
+func clampBatchSize(size int) int {
+	if size < 1 {
+		return 1
+	}
+	if size > protocol.MaxBetsPerMessage {
+		return protocol.MaxBetsPerMessage
+	}
+	return size
+}
+
+// chunkBuilder Chunk of bets being filled. bound is an upper bound of the
+// size of the chunk once encoded
+type chunkBuilder struct {
+	bets  []*Bet
+	bound int
+}
+
+// add Appends the bet to the chunk if it fits. plain must encode the
+// messages as sent but without compression, and sent as they are sent.
+// An error is returned if the bet does not fit even in an empty chunk
+func (s *batchSizer) add(plain protocol.Codec, sent protocol.Codec, chunk *chunkBuilder, bet *Bet) (bool, error) {
+	if len(chunk.bets) >= s.size {
+		return false, nil
+	}
+	if s.maxBytes > 0 {
+		// The size of every bet alone is an upper bound of its share of
+		// the chunk, twice it if the chunk may be compressed as the
+		// gzipped frame may be sent in base64. The whole chunk is only
+		// encoded when it gets close to the limit
+		cost, err := encodedSize(plain, bet.AgencyID, []*Bet{bet})
+		if err != nil {
+			return false, err
+		}
+		if sent != plain {
+			cost *= 2
+		}
+		bound := chunk.bound + cost
+		if bound > s.maxBytes {
+			bets := append(chunk.bets[:len(chunk.bets):len(chunk.bets)], bet)
+			bound, err = encodedSize(sent, bet.AgencyID, bets)
+			if err != nil {
+				return false, err
+			}
+		}
+		if bound > s.maxBytes {
+			if len(chunk.bets) == 0 {
+				return false, fmt.Errorf("bet %d does not fit in a message of %d bytes", bet.ID, s.maxBytes)
+			}
+			return false, nil
+		}
+		chunk.bound = bound
+	}
+	chunk.bets = append(chunk.bets, bet)
+	return true, nil
+}
+
+// encodedSize Returns the size of a message with the bets. The largest
+// sequence number is used, so the size is not exceeded later whatever
+// the number of the chunk
+func encodedSize(codec protocol.Codec, agencyID int, bets []*Bet) (int, error) {
+	data, err := codec.Encode(&protocol.Message{
+		Type:     protocol.MsgBets,
+		AgencyID: agencyID,
+		Seq:      math.MaxInt32,
+		Bets:     bets,
+	})
+	return len(data), err
+}
+
+// observe Adjusts the number of bets of the next chunks to the time the
+// server took to acknowledge the last one, of count bets. It only grows
+// after full chunks, the ones closed by maxBytes or the end of the file
+// would not take more bets. Returns true if the size changed
+func (s *batchSizer) observe(rtt time.Duration, count int) bool {
+	if s.targetRTT <= 0 {
+		return false
+	}
+	previous := s.size
+	if rtt > s.targetRTT {
+		s.size = clampBatchSize(s.size / 2)
+	} else if count >= s.size {
+		s.size = clampBatchSize(s.size + s.size/4 + 1)
+	}
+	return s.size != previous
+}
+
+// adjustBatchSize Adjusts the size of the next chunks to the time the
+// server took to ack a chunk of count bets
+func (c *Client) adjustBatchSize(rtt time.Duration, count int) {
+	if c.sizer.observe(rtt, count) {
+		c.logger.Debugf("action: batch_size | result: success | client_id: %v | size: %v | rtt: %v",
+			c.config.ID,
+			c.sizer.size,
+			rtt,
+		)
+	}
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+func TestBatchSizerObserve(t *testing.T) {
+	sizer := newBatchSizer(ClientConfig{BetChunkSize: 4, BetTargetRTT: 100 * time.Millisecond})
+	steps := []struct {
+		rtt   time.Duration
+		count int
+		size  int
+	}{
+		{10 * time.Millisecond, 4, 6},
+		// Chunks that were not full do not grow the size
+		{10 * time.Millisecond, 2, 6},
+		{200 * time.Millisecond, 6, 3},
+		{200 * time.Millisecond, 3, 1},
+		{200 * time.Millisecond, 1, 1},
+	}
+	for i, step := range steps {
+		sizer.observe(step.rtt, step.count)
+		if sizer.size != step.size {
+			t.Fatalf("step %d: got size %d, want %d", i, sizer.size, step.size)
+		}
+	}
+}
+
+func TestBatchSizerClampsToMaxBets(t *testing.T) {
+	sizer := newBatchSizer(ClientConfig{BetChunkSize: protocol.MaxBetsPerMessage + 10, BetTargetRTT: time.Second})
+	if sizer.size != protocol.MaxBetsPerMessage {
+		t.Fatalf("got size %d, want %d", sizer.size, protocol.MaxBetsPerMessage)
+	}
+	sizer.size = protocol.MaxBetsPerMessage - 1
+	sizer.observe(time.Millisecond, sizer.size)
+	if sizer.size != protocol.MaxBetsPerMessage {
+		t.Fatalf("got size %d, want %d", sizer.size, protocol.MaxBetsPerMessage)
+	}
+	if sizer.observe(time.Millisecond, sizer.size) {
+		t.Fatal("size grew beyond the bets of a message")
+	}
+}
+
+func TestBatchSizerFixedSize(t *testing.T) {
+	sizer := newBatchSizer(ClientConfig{BetChunkSize: 0})
+	if sizer.size != 1 {
+		t.Fatalf("got size %d, want 1", sizer.size)
+	}
+	if sizer.observe(time.Second, 1) || sizer.observe(0, 1) {
+		t.Fatal("size changed without BetTargetRTT")
+	}
+}
+
+func TestBatchSizerMaxBytes(t *testing.T) {
+	codec := protocol.TextCodec{}
+	bet := &Bet{AgencyID: 1, ID: 7, Name: "Ana", Surname: "Paz", PersonalID: 30904465, BirthDate: "1999-03-17"}
+	single, err := encodedSize(codec, 1, []*Bet{bet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizer := newBatchSizer(ClientConfig{BetChunkSize: 100, BetMaxBytes: 3 * single})
+	chunk := &chunkBuilder{}
+	for {
+		added, err := sizer.add(codec, codec, chunk, bet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			break
+		}
+	}
+	size, err := encodedSize(codec, 1, chunk.bets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigger, err := encodedSize(codec, 1, append(chunk.bets, bet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size > sizer.maxBytes || bigger <= sizer.maxBytes {
+		t.Fatalf("chunk of %d bets is %d bytes, limit %d", len(chunk.bets), size, sizer.maxBytes)
+	}
+
+	sizer.maxBytes = single - 1
+	if _, err := sizer.add(codec, codec, &chunkBuilder{}, bet); err == nil {
+		t.Fatal("a bet larger than BetMaxBytes was added")
+	}
+}
+
+// fillChunk Adds bets to a chunk until the sizer closes it
+func fillChunk(t *testing.T, sizer *batchSizer, plain protocol.Codec, sent protocol.Codec) []*Bet {
+	t.Helper()
+	chunk := &chunkBuilder{}
+	for i := 0; ; i++ {
+		bet := &Bet{AgencyID: 1, ID: i, Name: "Ana", Surname: "Paz", PersonalID: 30904465 + i, BirthDate: "1999-03-17"}
+		added, err := sizer.add(plain, sent, chunk, bet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			return chunk.bets
+		}
+	}
+}
+
+func TestBatchSizerMeasuresSentFrames(t *testing.T) {
+	base := protocol.TextCodec{}
+	plain := protocol.NewHMACCodec(base, base, []byte("secret"))
+	sent := protocol.NewHMACCodec(protocol.NewGzipCodec(base, 0, nil), base, []byte("secret"))
+	sizer := newBatchSizer(ClientConfig{BetChunkSize: 1000, BetMaxBytes: 4096})
+
+	uncompressed := fillChunk(t, sizer, plain, plain)
+	compressed := fillChunk(t, sizer, plain, sent)
+	if len(compressed) <= len(uncompressed) {
+		t.Fatalf("got %d compressed bets, %d uncompressed", len(compressed), len(uncompressed))
+	}
+	for codec, bets := range map[protocol.Codec][]*Bet{plain: uncompressed, sent: compressed} {
+		size, err := encodedSize(codec, 1, bets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > sizer.maxBytes {
+			t.Fatalf("chunk of %d bets is %d bytes, limit %d", len(bets), size, sizer.maxBytes)
+		}
+	}
+}
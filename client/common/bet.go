@@ -5,18 +5,11 @@ import (
 	"fmt"
 	"strconv"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
 )
 
-// Bet struct that represents a bet
-type Bet struct {
-	AgencyID   int // agency number
-	ID         int // bet number
-	Name       string
-	Surname    string
-	PersonalID int
-	BirthDate  string
-}
+// Bet struct that represents a bet, defined by the protocol package
+type Bet = protocol.Bet
 
 // NewBet Initializes a new bet
 func NewBet(AgencyID int, id int, name string, surname string, personalID int, birthDate string) *Bet {
@@ -52,22 +45,6 @@ func FromCSV(agencyID int, record []string) (*Bet, error) {
 	}, nil
 }
 
-// ToStr Returns a string representation of the bet
-func (b *Bet) ToStr() string {
-	return fmt.Sprintf("[AgencyID:%d,ID:%d,Name:%s,Surname:%s,PersonalID:%d,BirthDate:%s]",
-		b.AgencyID, b.ID, b.Name, b.Surname, b.PersonalID, b.BirthDate)
-}
-
-// GetBetID Returns the bet ID
-func (b *Bet) GetBetID() int {
-	return b.ID
-}
-
-// GetPesonalID Returns the personal ID
-func (b *Bet) GetPersonalID() int {
-	return b.PersonalID
-}
-
 // readBet Reads a bet from a CSV file
 func readBet(agencyID int, reader *csv.Reader) (*Bet, error) {
 	record, err := reader.Read()
@@ -84,9 +61,9 @@ func readBet(agencyID int, reader *csv.Reader) (*Bet, error) {
 }
 
 // logBets Logs the bets to the console
-func logBets(bets []*Bet, result string) {
+func (c *Client) logBets(bets []*Bet, result string) {
 	for _, bet := range bets {
-		log.Infof("action: apuesta_enviada | result: %s | dni: %v | numero: %v",
+		c.logger.Infof("action: apuesta_enviada | result: %s | dni: %v | numero: %v",
 			result,
 			bet.GetPersonalID(),
 			bet.GetBetID(),
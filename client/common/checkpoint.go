@@ -0,0 +1,276 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint Progress of the upload of the bets file, saved after every
+// acknowledged chunk so a restarted client continues where it stopped
+// instead of sending the whole file again
+type checkpoint struct {
+	// File Name of the bets file
+	File string `json:"file"`
+	// Offset Position in the file after the last acknowledged chunk
+	Offset int64 `json:"offset"`
+	// Row Number of bets acknowledged
+	Row int `json:"row"`
+	// Seq Number of chunks acknowledged
+	Seq int `json:"seq"`
+	// InFlight Chunks sent after chunk Seq, in order. A restarted client
+	// builds them again with the same bets, so the server recognizes the
+	// ones it already stored
+	InFlight []sentChunk `json:"in_flight,omitempty"`
+}
+
+// sentChunk Chunk sent to the server whose ack did not move the
+// checkpoint yet
+type sentChunk struct {
+	// Bets Number of bets read from the file for the chunk
+	Bets int `json:"bets"`
+	// Confirmed Number of its first bets acked by the server, which are
+	// not sent again
+	Confirmed int `json:"confirmed,omitempty"`
+}
+
+// offsetReader Reader of the bets file that hands out at most one line
+// per Read. As bufio only reads more when its buffer is empty, the
+// csv.Reader on top of it never reads past the record it is parsing, so
+// offset is the position in the file after the last record read
+type offsetReader struct {
+	reader  *bufio.Reader
+	pending []byte
+	offset  int64
+}
+
+// newOffsetReader Initializes a reader at the given offset of r
+func newOffsetReader(r io.Reader, offset int64) *offsetReader {
+	return &offsetReader{
+		reader:  bufio.NewReader(r),
+		pending: nil,
+		offset:  offset,
+	}
+}
+
+// Read Copies the rest of the current line into p
+func (r *offsetReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		line, err := r.reader.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+// checkpointPath Returns the path of the checkpoint of the agency, or
+// "" if checkpoints are disabled
+func (c *Client) checkpointPath() string {
+	if c.config.CheckpointDir == "" {
+		return ""
+	}
+	return filepath.Join(c.config.CheckpointDir, fmt.Sprintf("%s%d.checkpoint", c.config.FileDataName, c.config.ID))
+}
+
+// resumeUpload Returns the reader of the bets file, placed after the last
+// chunk acknowledged before the client was restarted according to its
+// checkpoint. The bets sent before are read again, so the winners can be
+// checked after the draw, and must match the checkpoint. The checkpoint
+// is deleted if RestartFromScratch is set
+// In case the checkpoint can not be read or does not match the file, an
+// InputError is returned
+func (c *Client) resumeUpload() (*csv.Reader, error) {
+	c.data_reader = newOffsetReader(c.data_file, 0)
+	path := c.checkpointPath()
+	if path == "" {
+		return csv.NewReader(c.data_reader), nil
+	}
+	c.progress.File = c.data_file.name
+	// Temporary files of writes interrupted by a crash
+	if stale, err := filepath.Glob(path + ".tmp*"); err == nil {
+		for _, tmp := range stale {
+			os.Remove(tmp)
+		}
+	}
+
+	if c.config.RestartFromScratch {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, &InputError{Path: path, Err: err}
+		}
+		c.logger.Infof("action: resume_upload | result: success | client_id: %v | msg: restarting from scratch",
+			c.config.ID,
+		)
+		return csv.NewReader(c.data_reader), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return csv.NewReader(c.data_reader), nil
+	}
+	if err != nil {
+		return nil, &InputError{Path: path, Err: err}
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, &InputError{Path: path, Err: fmt.Errorf("invalid checkpoint: %v", err)}
+	}
+	if saved.File != c.progress.File {
+		return nil, &InputError{Path: path, Err: fmt.Errorf("checkpoint belongs to %s, not to %s", saved.File, c.progress.File)}
+	}
+
+	// The bets file may not be seekable, the bets sent are read to get
+	// past them
+	limited := &io.LimitedReader{R: c.data_file, N: saved.Offset}
+	sent := csv.NewReader(limited)
+	rows := 0
+	for {
+		bet, err := readBet(c.config.ID, sent)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &InputError{Path: path, Err: fmt.Errorf("bets file does not match checkpoint: %v", err)}
+		}
+		c.uploaded_bets[bet.GetPersonalID()] = append(c.uploaded_bets[bet.GetPersonalID()], bet)
+		rows++
+	}
+	if rows != saved.Row {
+		return nil, &InputError{Path: path, Err: fmt.Errorf("bets file does not match checkpoint: %d bets before offset %d, expected %d", rows, saved.Offset, saved.Row)}
+	}
+	if limited.N > 0 {
+		return nil, &InputError{Path: path, Err: fmt.Errorf("bets file does not match checkpoint: it ends before offset %d", saved.Offset)}
+	}
+
+	c.data_reader = newOffsetReader(c.data_file, saved.Offset)
+	c.progress = saved
+	c.resend = saved.InFlight
+	c.logger.Infof("action: resume_upload | result: success | client_id: %v | row: %v | seq: %v",
+		c.config.ID,
+		saved.Row,
+		saved.Seq,
+	)
+	return csv.NewReader(c.data_reader), nil
+}
+
+// saveCheckpoint Records that the bets up to offset, row bets in seq
+// chunks, were acknowledged. A failure is only logged, the upload goes on
+func (c *Client) saveCheckpoint(offset int64, row int, seq int) {
+	if acked := seq - c.progress.Seq; acked < len(c.progress.InFlight) {
+		c.progress.InFlight = c.progress.InFlight[acked:]
+	} else {
+		c.progress.InFlight = nil
+	}
+	c.progress.Offset = offset
+	c.progress.Row = row
+	c.progress.Seq = seq
+	c.writeCheckpoint()
+}
+
+// sendingChunk Records that chunk seq, of count bets, is about to be sent.
+// Returns how many of its first bets the server already acked, if the
+// chunk was sent before the client was restarted
+func (c *Client) sendingChunk(seq int, count int) int {
+	if i := seq - c.progress.Seq - 1; i < len(c.progress.InFlight) {
+		return c.progress.InFlight[i].Confirmed
+	}
+	c.progress.InFlight = append(c.progress.InFlight, sentChunk{Bets: count})
+	c.writeCheckpoint()
+	return 0
+}
+
+// chunkConfirmed Records that the server acked count more bets of chunk
+// seq, which are not sent again. Chunks that are not in the checkpoint
+// are ignored
+func (c *Client) chunkConfirmed(seq int, count int) {
+	i := seq - c.progress.Seq - 1
+	if i < 0 || i >= len(c.progress.InFlight) {
+		return
+	}
+	c.progress.InFlight[i].Confirmed += count
+	c.writeCheckpoint()
+}
+
+// writeCheckpoint Saves the progress to the checkpoint of the agency. A
+// failure is only logged, the upload goes on
+func (c *Client) writeCheckpoint() {
+	path := c.checkpointPath()
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(c.progress)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		c.logger.Warnf("action: save_checkpoint | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+	}
+}
+
+// removeCheckpoint Deletes the checkpoint once the draw was received, so
+// running the client again uploads the whole file, e.g. to a new server.
+// It is kept while waiting for the draw, so a client restarted then does
+// not send the bets again. A failure is only logged
+func (c *Client) removeCheckpoint() {
+	path := c.checkpointPath()
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		c.logger.Warnf("action: remove_checkpoint | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+	}
+}
+
+// writeFileAtomic Writes the file through a temporary file in the same
+// directory that is renamed over it, so after a crash the file holds
+// either the old or the new data
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBets Bets file of agency 1, one of its names has a line break
+const testBets = "Ana,Paz,30904465,1999-03-17,7\n" +
+	"\"Juan\nCarlos\",Gil,20025664,1980-01-02,8\n" +
+	"Eva,Sosa,10000000,2000-12-20,9\n"
+
+// setBetsFile Makes the client read the bets from content
+func setBetsFile(c *Client, content string) {
+	c.data_file = &betsFile{Reader: strings.NewReader(content), path: "agency-1.csv", name: "agency-1.csv"}
+}
+
+func TestOffsetReaderTracksRecords(t *testing.T) {
+	reader := newOffsetReader(strings.NewReader(testBets), 100)
+	records := csv.NewReader(reader)
+	lines := strings.SplitAfter(testBets, "\n")
+	want := []int64{
+		100 + int64(len(lines[0])),
+		100 + int64(len(lines[0])+len(lines[1])+len(lines[2])),
+		100 + int64(len(testBets)),
+	}
+	for i, offset := range want {
+		if _, err := records.Read(); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if reader.offset != offset {
+			t.Fatalf("record %d: got offset %d, want %d", i, reader.offset, offset)
+		}
+	}
+	if _, err := records.Read(); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+func TestOffsetReaderShortReads(t *testing.T) {
+	reader := newOffsetReader(strings.NewReader("abc\nde"), 0)
+	buffer := make([]byte, 2)
+	var read []string
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			read = append(read, string(buffer[:n]))
+		}
+		if err != nil {
+			break
+		}
+	}
+	want := []string{"ab", "c\n", "de"}
+	if strings.Join(read, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q, want %q", read, want)
+	}
+	if reader.offset != 6 {
+		t.Fatalf("got offset %d, want 6", reader.offset)
+	}
+}
+
+// writeCheckpoint Saves the checkpoint of agency 1 in dir
+func writeCheckpoint(t *testing.T, dir string, saved checkpoint) {
+	t.Helper()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "agency-1.checkpoint"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	dir := t.TempDir()
+	lines := strings.SplitAfter(testBets, "\n")
+	offset := int64(len(lines[0]) + len(lines[1]) + len(lines[2]))
+	writeCheckpoint(t, dir, checkpoint{File: "agency-1.csv", Offset: offset, Row: 2, Seq: 1})
+
+	c := newTestClient(t, ClientConfig{CheckpointDir: dir})
+	setBetsFile(c, testBets)
+	reader, err := c.resumeUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.progress.Row != 2 || c.progress.Seq != 1 || c.progress.Offset != offset {
+		t.Fatalf("got progress %+v", c.progress)
+	}
+	if len(c.uploaded_bets[30904465]) != 1 || len(c.uploaded_bets[20025664]) != 1 {
+		t.Fatalf("bets sent before the restart were not kept: %v", c.uploaded_bets)
+	}
+	bet, err := readBet(1, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bet.Name != "Eva" || c.data_reader.offset != int64(len(testBets)) {
+		t.Fatalf("resumed at %+v, offset %d", bet, c.data_reader.offset)
+	}
+}
+
+func TestResumeUploadWithoutCheckpoint(t *testing.T) {
+	c := newTestClient(t, ClientConfig{CheckpointDir: t.TempDir()})
+	setBetsFile(c, testBets)
+	reader, err := c.resumeUpload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bet, err := readBet(1, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bet.Name != "Ana" || c.progress.Row != 0 {
+		t.Fatalf("got %+v, progress %+v", bet, c.progress)
+	}
+}
+
+func TestResumeUploadRejectsMismatches(t *testing.T) {
+	first := int64(len(strings.SplitAfter(testBets, "\n")[0]))
+	cases := map[string]checkpoint{
+		"other file":   {File: "agency-2.csv", Offset: first, Row: 1, Seq: 1},
+		"other rows":   {File: "agency-1.csv", Offset: first, Row: 2, Seq: 1},
+		"shorter file": {File: "agency-1.csv", Offset: int64(len(testBets)) + 10, Row: 3, Seq: 1},
+	}
+	for name, saved := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeCheckpoint(t, dir, saved)
+			c := newTestClient(t, ClientConfig{CheckpointDir: dir})
+			setBetsFile(c, testBets)
+			_, err := c.resumeUpload()
+			var inputErr *InputError
+			if !errors.As(err, &inputErr) {
+				t.Fatalf("got %v, want an InputError", err)
+			}
+		})
+	}
+}
+
+func TestResumeUploadFromScratch(t *testing.T) {
+	dir := t.TempDir()
+	writeCheckpoint(t, dir, checkpoint{File: "agency-1.csv", Offset: 10, Row: 1, Seq: 1})
+	c := newTestClient(t, ClientConfig{CheckpointDir: dir, RestartFromScratch: true})
+	setBetsFile(c, testBets)
+	if _, err := c.resumeUpload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.checkpointPath()); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint was not deleted: %v", err)
+	}
+	if c.progress.Row != 0 {
+		t.Fatalf("got progress %+v", c.progress)
+	}
+}
+
+func TestCheckpointRemovedAfterDraw(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, ClientConfig{CheckpointDir: dir})
+	c.progress.File = "agency-1.csv"
+	c.saveCheckpoint(10, 1, 1)
+	if _, err := os.Stat(c.checkpointPath()); err != nil {
+		t.Fatalf("checkpoint was not saved: %v", err)
+	}
+	c.removeCheckpoint()
+	if _, err := os.Stat(c.checkpointPath()); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint was not deleted: %v", err)
+	}
+	// Removing it again is not a failure
+	c.removeCheckpoint()
+}
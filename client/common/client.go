@@ -1,136 +1,278 @@
 package common
 
 import (
+	"context"
 	"encoding/csv"
-	"net"
-	"os"
+	"fmt"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/sirupsen/logrus"
 )
 
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
-	ID            int
-	ServerAddress string
-	LoopLapse     time.Duration
-	LoopPeriod    time.Duration
-	BetChunkSize  int
-	DirDataPath   string
-	FileDataName  string
+	ID                   int
+	ServerAddress        string
+	LoopLapse            time.Duration
+	LoopPeriod           time.Duration
+	BetChunkSize         int
+	BetMaxBytes          int
+	BetTargetRTT         time.Duration
+	BetsPerSecond        float64
+	BatchesPerSecond     float64
+	DirDataPath          string
+	FileDataName         string
+	Input                string
+	WatchDirectory       bool
+	BetMaxRetries        int
+	BetWindow            int
+	ProtocolFormat       string
+	Handshake            bool
+	Compression          bool
+	CompressionThreshold int
+	TLS                  TLSConfig
+	Transport            Transport
+	ConnectTimeout       time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	HeartbeatInterval    time.Duration
+	HeartbeatTimeout     time.Duration
+	Subscribe            bool
+	SubscribeTimeout     time.Duration
+	AuthSecret           string
+	// AuthSecrets Secrets of the agencies run by RunAgencies, by ID.
+	// Agencies without one use AuthSecret
+	AuthSecrets        map[int]string
+	Reconnect          ReconnectConfig
+	CheckpointDir      string
+	RestartFromScratch bool
+	// Logger Destination of the logs of the client, the standard logger
+	// of logrus if nil
+	Logger logrus.FieldLogger
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config       ClientConfig
-	conn         net.Conn
-	data_file    *os.File
-	stop_chan    chan bool
-	personal_ids map[int]bool
+	config        ClientConfig
+	logger        logrus.FieldLogger
+	transport     Transport
+	link          link
+	mux           *Mux
+	codec         protocol.Codec
+	plain_codec   protocol.Codec
+	size_codec    protocol.Codec
+	welcome       *protocol.Welcome
+	backoff       *backoff
+	sizer         *batchSizer
+	limiter       *rateLimiter
+	data_file     *betsFile
+	data_reader   *offsetReader
+	read_offset   int64
+	pending       *Bet
+	pending_end   int64
+	progress      checkpoint
+	resend        []sentChunk
+	uploaded_bets map[int][]*Bet
+	draw          *protocol.DrawResult
+	// on_uploaded Called once the bets file was uploaded, before waiting
+	// for the draw
+	on_uploaded func()
+}
+
+// loggerOf Returns the logger of the config
+func loggerOf(config ClientConfig) logrus.FieldLogger {
+	if config.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return config.Logger
 }
 
 // NewClient Initializes a new client receiving the configuration
-// as a parameter
-func NewClient(config ClientConfig) *Client {
+// as a parameter. An error is returned if the protocol format is unknown
+// or the server address or the TLS configuration are not valid. If
+// config.Transport is nil the transport is parsed from ServerAddress
+func NewClient(config ClientConfig) (*Client, error) {
+	codec, err := protocol.NewCodec(config.ProtocolFormat)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
 	client := &Client{
-		config:       config,
-		conn:         nil,
-		data_file:    nil,
-		stop_chan:    make(chan bool),
-		personal_ids: make(map[int]bool),
+		config:        config,
+		logger:        loggerOf(config),
+		transport:     transport,
+		link:          nil,
+		mux:           nil,
+		codec:         nil,
+		plain_codec:   nil,
+		size_codec:    nil,
+		welcome:       nil,
+		backoff:       newBackoff(config.Reconnect),
+		sizer:         newBatchSizer(config),
+		limiter:       newRateLimiter(config),
+		data_file:     nil,
+		data_reader:   nil,
+		read_offset:   0,
+		pending:       nil,
+		pending_end:   0,
+		progress:      checkpoint{},
+		resend:        nil,
+		uploaded_bets: make(map[int][]*Bet),
+		draw:          nil,
+		on_uploaded:   nil,
 	}
-	return client
+	client.setCodecs(codec, codec)
+	return client, nil
 }
 
 // StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// The loop stops as soon as ctx is done or LoopLapse (no limit if 0)
+// elapsed, in any of its phases. With WatchDirectory the client uploads
+// the bets written to DirDataPath until ctx is done instead, see
+// watchDirectory. The socket and the file are closed once
+// on return
+// In case of failure, the error is returned: an InputError, ConnectError,
+// ProtocolError, ServerRejected or Canceled error. The Canceled error
+// wraps ErrLapseExceeded if the loop did not finish within LoopLapse
+func (c *Client) StartClientLoop(ctx context.Context) error {
+	if c.config.WatchDirectory {
+		return c.watchDirectory(ctx)
+	}
+	if c.config.LoopLapse <= 0 {
+		return c.runLoop(ctx)
+	}
+	lapseCtx, cancel := context.WithTimeout(ctx, c.config.LoopLapse)
+	defer cancel()
+	err := c.runLoop(lapseCtx)
+	if err != nil && ctx.Err() == nil && lapseCtx.Err() == context.DeadlineExceeded {
+		c.logger.Errorf("action: loop_finished | result: fail | client_id: %v | lapse: %v | error: %v",
+			c.config.ID,
+			c.config.LoopLapse,
+			ErrLapseExceeded,
+		)
+		return &Canceled{Err: fmt.Errorf("%w: %v", ErrLapseExceeded, c.config.LoopLapse)}
+	}
+	return err
+}
+
+// runLoop Uploads the bets file and waits for the draw
+func (c *Client) runLoop(ctx context.Context) error {
 	err := c.openFile()
-	defer c.data_file.Close()
 	if err != nil {
-		log.Fatalf("action: open_file | result: fail | client_id: %v | error: %v",
+		c.logger.Errorf("action: open_file | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
-		return
+		return err
 	}
+	defer c.closeFile()
 
-	reader := csv.NewReader(c.data_file)
+	reader, err := c.resumeUpload()
+	if err != nil {
+		c.logger.Errorf("action: resume_upload | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+
+	defer c.closeClientSocket()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
 
-	err = c.createClientSocket()
-	defer c.conn.Close()
+	if c.config.BetWindow > 1 {
+		err = c.sendBetsPipelined(ctx, reader)
+	} else {
+		err = c.sendBetsStopAndWait(ctx, reader)
+	}
+	if err != nil {
+		return err
+	}
+	if c.on_uploaded != nil {
+		c.on_uploaded()
+	}
+
+	if c.subscribed() {
+		err = c.subscribeResults(ctx)
+	} else {
+		err = c.pollResults(ctx)
+	}
 	if err != nil {
-		return
+		return err
 	}
+	c.removeCheckpoint()
 
+	c.logger.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return nil
+}
+
+// sendBetsStopAndWait Sends the bets of the file one chunk at a time,
+// waiting for the ack of each chunk before sending the next one, as fast
+// as the rate limits allow. The checkpoint is saved after every ack
+// In case of failure, error is returned
+func (c *Client) sendBetsStopAndWait(ctx context.Context, reader *csv.Reader) error {
 	for {
-		bets, end, shouldReturn1 := c.readBets(reader)
-		if shouldReturn1 {
-			return
+		bets, end, err := c.readBets(reader)
+		if err != nil {
+			return err
 		}
 		if len(bets) == 0 {
 			break
 		}
-		shouldReturn2 := sendBets(c, bets)
-		if shouldReturn2 {
-			return
+		offset := c.read_offset
+		if err := c.throttle(ctx, len(bets)); err != nil {
+			return err
+		}
+		seq := c.progress.Seq + 1
+		confirmed := c.sendingChunk(seq, len(bets))
+		if err := sendBets(ctx, c, seq, bets[confirmed:]); err != nil {
+			return err
 		}
+		c.saveCheckpoint(offset, c.progress.Row+len(bets), seq)
 		if end {
 			break
 		}
-
-		result, err := c.receiveMessage()
-		if err != nil {
-			return
-		}
-		if len(result) == 0 {
-			log.Warnf("action: receive_message | result: fail | client_id: %v | error: empty message",
-				c.config.ID,
-			)
-			c.StopClient()
-			return
-		}
-
-		_, shouldReturn, _ := c.manageServerResponse(result)
-		if shouldReturn {
-			c.StopClient()
-			return
-		}
-
-		shouldReturn = c.waitOrStop()
-		if shouldReturn {
-			return
-		}
 	}
+	return nil
+}
 
+// pollResults Asks for the results every loop period until the draw
+// is made. If the connection fails the client reconnects and asks again
+// In case of failure, error is returned
+func (c *Client) pollResults(ctx context.Context) error {
 	wait := true
 	for wait {
-		wait, err = c.askResults()
+		var err error
+		wait, err = c.askResults(ctx)
+		if err := c.stopped(ctx); err != nil {
+			return err
+		}
+		if retryable(err) {
+			if err := c.reconnect(ctx, err); err != nil {
+				return err
+			}
+			wait = true
+			continue
+		}
 		if err != nil {
-			return
+			c.logger.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return err
 		}
+		c.backoff.reset()
 		// Wait a time between sending one message and the next one
-		shouldReturn := c.waitOrStop()
-		if shouldReturn {
-			return
+		if wait {
+			if err := c.waitForDraw(ctx); err != nil {
+				return err
+			}
 		}
 	}
-
-	err = c.closeClientSocket()
-	if err != nil {
-		return
-	}
-
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
-}
-
-// StopClient Stops the client loop
-func (c *Client) StopClient() {
-	defer func() {
-		c.stop_chan <- true
-		log.Infof("action: stop_loop | result: success | client_id: %v",
-			c.config.ID,
-		)
-		c.closeClientSocket()
-		c.closeFile()
-	}()
+	return nil
 }
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// serveUntil Acks the chunks of bets and answers the results queries
+// with WAIT, never making the draw. If acks is false the chunks are not
+// acked either
+func serveUntil(acks bool) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+		encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+		for {
+			msg, err := decoder.Decode()
+			if err != nil {
+				return
+			}
+			reply := &protocol.Response{Kind: protocol.ResponseWait, Message: "Esperando a las otras agencias"}
+			if msg.Type == protocol.MsgBets {
+				if !acks {
+					continue
+				}
+				reply = &protocol.Response{Kind: protocol.ResponseBatchAck, Count: len(msg.Bets), Seq: msg.Seq}
+			}
+			if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: reply.String()}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestStartClientLoopStopsWhenCanceled(t *testing.T) {
+	phases := []struct {
+		name   string
+		window int
+		acks   bool
+	}{
+		{"uploading", 1, false},
+		{"uploading with a window", 3, false},
+		{"waiting for the draw", 1, true},
+	}
+	for _, phase := range phases {
+		t.Run(phase.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeBetsFile(t, dir, 1, 5)
+			c := newTestClient(t, ClientConfig{
+				DirDataPath:  dir,
+				BetChunkSize: 2,
+				BetWindow:    phase.window,
+				LoopPeriod:   time.Minute,
+				Transport:    &PipeTransport{Serve: serveUntil(phase.acks)},
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			done := make(chan error, 1)
+			go func() { done <- c.StartClientLoop(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the client did not stop")
+			}
+			var canceled *Canceled
+			if !errors.As(err, &canceled) || !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want Canceled", err)
+			}
+			if c.link != nil || c.data_file != nil {
+				t.Fatal("the socket or the file was left open")
+			}
+
+			// Stopping again does nothing
+			cancel()
+			if err := c.closeClientSocket(); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.closeFile(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStartClientLoopGivesUpAfterTheLapse(t *testing.T) {
+	dir := t.TempDir()
+	writeBetsFile(t, dir, 1, 10)
+	server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+		time.Sleep(20 * time.Millisecond)
+		return len(bets), false
+	})
+	config := uploadConfig(dir, server, 1)
+	config.LoopLapse = 30 * time.Millisecond
+	c := newTestClient(t, config)
+
+	start := time.Now()
+	err := c.StartClientLoop(context.Background())
+	var canceled *Canceled
+	if !errors.As(err, &canceled) || !errors.Is(err, ErrLapseExceeded) {
+		t.Fatalf("got %v, want Canceled by ErrLapseExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+	if c.link != nil || c.data_file != nil {
+		t.Fatal("the socket or the file was left open")
+	}
+}
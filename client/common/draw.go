@@ -0,0 +1,49 @@
+package common
+
+import (
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// checkWinners Matches the winners of the draw with the bets uploaded by
+// the agency. Returns the bets uploaded by the winners and the personal
+// IDs of the winners that do not belong to any uploaded bet
+func (c *Client) checkWinners(draw *protocol.DrawResult) ([]*Bet, []int) {
+	winningBets := []*Bet{}
+	unknown := []int{}
+	for _, winner := range draw.Winners {
+		bets, ok := c.uploaded_bets[winner]
+		if !ok {
+			unknown = append(unknown, winner)
+			continue
+		}
+		winningBets = append(winningBets, bets...)
+	}
+	return winningBets, unknown
+}
+
+// getWinners Keeps and logs the winners of the agency sent by the server
+// and their bets. Winners that did not bet in the agency are flagged
+func (c *Client) getWinners(draw *protocol.DrawResult) {
+	c.draw = draw
+	c.logger.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v",
+		len(draw.Winners),
+	)
+
+	winningBets, unknown := c.checkWinners(draw)
+	for _, bet := range winningBets {
+		c.logger.Infof("action: apuesta_ganadora | result: success | client_id: %v | dni: %v | numero: %v | nombre: %v | apellido: %v | nacimiento: %v",
+			c.config.ID,
+			bet.PersonalID,
+			bet.ID,
+			bet.Name,
+			bet.Surname,
+			bet.BirthDate,
+		)
+	}
+	for _, winner := range unknown {
+		c.logger.Warnf("action: apuesta_ganadora | result: fail | client_id: %v | dni: %v | error: winner not found in the bets of the agency",
+			c.config.ID,
+			winner,
+		)
+	}
+}
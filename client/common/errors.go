@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// ConnectError The server could not be reached, or the connection to it
+// failed and the client gave up reconnecting
+type ConnectError struct {
+	// Address Address of the server
+	Address string
+	// Err Failure of the last attempt
+	Err error
+}
+
+// Error Returns the description of the error
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("cannot connect to %s: %v", e.Address, e.Err)
+}
+
+// Unwrap Returns the failure of the last attempt
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError The server replied something the client does not
+// understand or did not expect
+type ProtocolError struct {
+	Err error
+}
+
+// Error Returns the description of the error
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error: %v", e.Err)
+}
+
+// Unwrap Returns the cause of the error
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// protocolError Returns a ProtocolError with the formatted description
+func protocolError(format string, args ...interface{}) error {
+	return &ProtocolError{Err: fmt.Errorf(format, args...)}
+}
+
+// ServerRejected The server answered a message of the client with an
+// error, e.g. it refused the handshake or a chunk of bets
+type ServerRejected struct {
+	// Code Code of the error, empty if the server did not send one
+	Code string
+	// Message Description sent by the server
+	Message string
+}
+
+// Error Returns the description of the error
+func (e *ServerRejected) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("rejected by server: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("rejected by server: %s", e.Message)
+}
+
+// rejected Returns the ServerRejected error of an error reply
+func rejected(response *protocol.Response) error {
+	return &ServerRejected{Code: response.Code, Message: response.Message}
+}
+
+// InputError The bets file, or the checkpoint of its upload, could not be
+// read or holds invalid data
+type InputError struct {
+	// Path Path of the file, empty for bets submitted to a Session
+	Path string
+	// Err Cause of the error
+	Err error
+}
+
+// Error Returns the description of the error
+func (e *InputError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid input: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid input %s: %v", e.Path, e.Err)
+}
+
+// Unwrap Returns the cause of the error
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// Canceled The client was stopped before finishing, or gave up waiting
+// for the draw after SubscribeTimeout
+type Canceled struct {
+	// Err Reason of the stop, the error of the context if it was canceled
+	Err error
+}
+
+// Error Returns the description of the error
+func (e *Canceled) Error() string {
+	return fmt.Sprintf("client stopped: %v", e.Err)
+}
+
+// Unwrap Returns the error of the context
+func (e *Canceled) Unwrap() error {
+	return e.Err
+}
+
+// ErrLapseExceeded The client did not finish within LoopLapse
+var ErrLapseExceeded = errors.New("loop lapse exceeded")
+
+// stopped Returns a Canceled error and logs that the loop was aborted if
+// ctx is done, nil otherwise
+func (c *Client) stopped(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	c.logger.Warnf("action: loop_finished | result: aborted | client_id: %v | error: %v",
+		c.config.ID,
+		ctx.Err(),
+	)
+	return &Canceled{Err: ctx.Err()}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"context"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// requestedFeatures Returns the optional features enabled in the config
+func requestedFeatures(config ClientConfig) []string {
+	features := []string{}
+	if config.ProtocolFormat == protocol.FormatBinary {
+		features = append(features, protocol.FeatureBinary)
+	}
+	if config.Compression {
+		features = append(features, protocol.FeatureGzip)
+	}
+	if config.HeartbeatInterval > 0 {
+		features = append(features, protocol.FeatureHeartbeat)
+	}
+	if config.Subscribe {
+		features = append(features, protocol.FeatureSubscribe)
+	}
+	if signsMessages(config) {
+		features = append(features, protocol.FeatureAuth)
+	}
+	return features
+}
+
+// signsMessages Returns whether the config has the secret of any agency,
+// so its messages are signed
+func signsMessages(config ClientConfig) bool {
+	if config.AuthSecret != "" {
+		return true
+	}
+	for _, secret := range config.AuthSecrets {
+		if secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// welcomeOf Returns the server answer to the handshake. A ServerRejected
+// error is returned if the server rejected it, and a ProtocolError if it
+// replied something else
+func welcomeOf(response *protocol.Response) (*protocol.Welcome, error) {
+	switch response.Kind {
+	case protocol.ResponseWelcome:
+		return response.Welcome, nil
+	case protocol.ResponseError:
+		return nil, rejected(response)
+	}
+	return nil, protocolError("unexpected %v reply to the handshake", response.Kind)
+}
+
+// negotiatedCodec Returns the codec of the features accepted by the
+// server and the base codec of its wire format
+func negotiatedCodec(config ClientConfig, welcome *protocol.Welcome) (protocol.Codec, protocol.Codec) {
+	logger := loggerOf(config)
+	var base protocol.Codec = protocol.TextCodec{}
+	if welcome.HasFeature(protocol.FeatureBinary) {
+		base = protocol.BinaryCodec{}
+	} else if config.ProtocolFormat == protocol.FormatBinary {
+		logger.Warnf("action: handshake | result: in_progress | client_id: %v | msg: binary format not supported by server, using text",
+			config.ID,
+		)
+	}
+	if signsMessages(config) && !welcome.HasFeature(protocol.FeatureAuth) {
+		logger.Warnf("action: handshake | result: in_progress | client_id: %v | msg: auth not supported by server, sending unsigned messages",
+			config.ID,
+		)
+	}
+	codec := base
+	if welcome.HasFeature(protocol.FeatureGzip) {
+		codec = protocol.NewGzipCodec(base, config.CompressionThreshold, func(agencyID int, originalSize int, compressedSize int) {
+			logCompression(logger, agencyID, originalSize, compressedSize)
+		})
+	}
+	return codec, base
+}
+
+// logHandshake Logs the protocol version and features chosen by the server
+func logHandshake(logger logrus.FieldLogger, agencyID int, welcome *protocol.Welcome) {
+	logger.Infof("action: handshake | result: success | client_id: %v | version: %v | features: %v",
+		agencyID,
+		welcome.Version,
+		strings.Join(welcome.Features, ","),
+	)
+}
+
+// handshake Announces the agency, the supported protocol versions and the
+// requested features to the server and waits for its choice. The handshake
+// is always sent in the text format, the configured format is only used
+// afterwards if the server accepted it. An error is returned if the server
+// rejects the handshake or there is no common version
+func (c *Client) handshake(ctx context.Context) error {
+	c.welcome = nil
+	c.setCodecs(protocol.TextCodec{}, protocol.TextCodec{})
+
+	err := c.sendMessage(ctx, &protocol.Message{
+		Type:     protocol.MsgHello,
+		AgencyID: c.config.ID,
+		Versions: protocol.SupportedVersions,
+		Features: requestedFeatures(c.config),
+	})
+	if err != nil {
+		return err
+	}
+
+	response, err := c.receiveResponse(ctx)
+	if err != nil {
+		return err
+	}
+	welcome, err := welcomeOf(response)
+	if err != nil {
+		return err
+	}
+	c.welcome = welcome
+	c.setCodecs(negotiatedCodec(c.config, welcome))
+
+	logHandshake(c.logger, c.config.ID, welcome)
+	return nil
+}
+
+// logCompression Logs the sizes of a compressed message
+func logCompression(logger logrus.FieldLogger, agencyID int, originalSize int, compressedSize int) {
+	logger.Infof("action: compress_message | result: success | client_id: %v | original_size: %v | compressed_size: %v | ratio: %.2f",
+		agencyID,
+		originalSize,
+		compressedSize,
+		float64(originalSize)/float64(compressedSize),
+	)
+}
+
+// signed Wraps the codec to sign every message if the agency has a
+// secret and the server accepted the auth feature, base encodes the
+// envelope of the signed messages
+func (c *Client) signed(codec protocol.Codec, base protocol.Codec) protocol.Codec {
+	if c.config.AuthSecret == "" || c.welcome == nil || !c.welcome.HasFeature(protocol.FeatureAuth) {
+		return codec
+	}
+	return protocol.NewHMACCodec(codec, base, []byte(c.config.AuthSecret))
+}
+
+// setCodecs Changes the codec used to talk to the server, signed if the
+// agency has a secret and signing was negotiated. base is the codec
+// without compression. The chunks of bets are measured with the same
+// codecs, without logging the compression
+func (c *Client) setCodecs(codec protocol.Codec, base protocol.Codec) {
+	c.codec = c.signed(codec, base)
+	c.plain_codec = c.signed(base, base)
+	c.size_codec = c.plain_codec
+	if _, ok := codec.(*protocol.GzipCodec); ok {
+		c.size_codec = c.signed(protocol.NewGzipCodec(base, c.config.CompressionThreshold, nil), base)
+	}
+	if c.link != nil {
+		c.link.setCodec(c.codec)
+	}
+}
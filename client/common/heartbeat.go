@@ -0,0 +1,70 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// errPeerUnresponsive The server did not answer a heartbeat in time
+var errPeerUnresponsive = errors.New("server not responding to heartbeats")
+
+// heartbeats Returns true if heartbeats are configured and the server
+// accepted them in the handshake
+func (c *Client) heartbeats() bool {
+	return c.config.HeartbeatInterval > 0 &&
+		c.welcome != nil &&
+		c.welcome.HasFeature(protocol.FeatureHeartbeat)
+}
+
+// waitForDraw Waits the loop period before asking for the results again.
+// Meanwhile the server is pinged every HeartbeatInterval, so a dead
+// server is detected within HeartbeatInterval + HeartbeatTimeout even
+// if the loop period is longer, and the client reconnects
+// In case the client should stop, error is returned
+func (c *Client) waitForDraw(ctx context.Context) error {
+	end := time.Now().Add(c.config.LoopPeriod)
+	for c.heartbeats() && time.Until(end) > c.config.HeartbeatInterval {
+		if err := c.waitFor(ctx, c.config.HeartbeatInterval); err != nil {
+			return err
+		}
+		if err := c.ping(ctx); err != nil {
+			if err := c.stopped(ctx); err != nil {
+				return err
+			}
+			c.logger.Errorf("action: heartbeat | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			if err := c.reconnect(ctx, err); err != nil {
+				return err
+			}
+		}
+	}
+	return c.waitFor(ctx, time.Until(end))
+}
+
+// ping Sends a heartbeat and waits HeartbeatTimeout for its PONG
+// An errPeerUnresponsive error is returned if it does not arrive
+func (c *Client) ping(ctx context.Context) error {
+	err := c.sendMessage(ctx, &protocol.Message{
+		Type:     protocol.MsgPing,
+		AgencyID: c.config.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPeerUnresponsive, err)
+	}
+
+	response, err := c.receiveResponseWithin(ctx, c.config.HeartbeatTimeout)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPeerUnresponsive, err)
+	}
+	if response.Kind != protocol.ResponsePong {
+		return protocolError("unexpected %v reply to a heartbeat", response.Kind)
+	}
+	c.logger.Debugf("action: heartbeat | result: success | client_id: %v", c.config.ID)
+	return nil
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// heartbeatServer Fake server that accepts heartbeats and counts the
+// handshakes and pings received, answering the pings with PONG only if
+// pong is set
+type heartbeatServer struct {
+	pong   bool
+	hellos int32
+	pings  int32
+}
+
+// serve Answers the messages of a connection until the client closes it
+func (s *heartbeatServer) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+	encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+	for {
+		msg, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+		var reply *protocol.Response
+		switch msg.Type {
+		case protocol.MsgHello:
+			atomic.AddInt32(&s.hellos, 1)
+			reply = &protocol.Response{
+				Kind:    protocol.ResponseWelcome,
+				Welcome: &protocol.Welcome{Version: 1, Features: []string{protocol.FeatureHeartbeat}},
+			}
+		case protocol.MsgPing:
+			atomic.AddInt32(&s.pings, 1)
+			if !s.pong {
+				continue
+			}
+			reply = &protocol.Response{Kind: protocol.ResponsePong}
+		default:
+			reply = &protocol.Response{Kind: protocol.ResponseError, Message: "Mensaje no reconocido"}
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: reply.String()}); err != nil {
+			return
+		}
+	}
+}
+
+// heartbeatClient Returns a client connected to server that waits period
+// for the draw, pinging the server every 5ms
+func heartbeatClient(t *testing.T, server *heartbeatServer, period time.Duration) *Client {
+	t.Helper()
+	c := newTestClient(t, ClientConfig{
+		Transport:         &PipeTransport{Serve: server.serve},
+		Handshake:         true,
+		LoopPeriod:        period,
+		HeartbeatInterval: 5 * time.Millisecond,
+		HeartbeatTimeout:  20 * time.Millisecond,
+		Reconnect: ReconnectConfig{
+			InitialDelay: time.Millisecond,
+			MaxAttempts:  2,
+		},
+	})
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.closeClientSocket() })
+	return c
+}
+
+func TestWaitForDrawPingsTheServer(t *testing.T) {
+	server := &heartbeatServer{pong: true}
+	c := heartbeatClient(t, server, 50*time.Millisecond)
+	start := time.Now()
+	if err := c.waitForDraw(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("waited %v, want the loop period", elapsed)
+	}
+	if pings := atomic.LoadInt32(&server.pings); pings < 2 {
+		t.Fatalf("got %d pings while waiting", pings)
+	}
+	if hellos := atomic.LoadInt32(&server.hellos); hellos != 1 {
+		t.Fatalf("got %d connections, want 1", hellos)
+	}
+}
+
+func TestWaitForDrawGivesUpOnASilentServer(t *testing.T) {
+	server := &heartbeatServer{pong: false}
+	c := heartbeatClient(t, server, time.Minute)
+	start := time.Now()
+	err := c.waitForDraw(context.Background())
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || !errors.Is(err, errPeerUnresponsive) {
+		t.Fatalf("got %v, want a ConnectError after unanswered heartbeats", err)
+	}
+	// Every connection is dropped once its ping is not answered
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+	// The first connection and the 2 reconnections are pinged once each
+	pings, hellos := atomic.LoadInt32(&server.pings), atomic.LoadInt32(&server.hellos)
+	if pings != 3 || hellos != 3 {
+		t.Fatalf("got %d pings over %d connections, want 3 over 3", pings, hellos)
+	}
+}
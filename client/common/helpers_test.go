@@ -0,0 +1,209 @@
+package common
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// discardLogger Returns a logger that discards the logs
+func discardLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// newTestClient Returns a client of agency 1 whose logs are discarded
+func newTestClient(t *testing.T, config ClientConfig) *Client {
+	t.Helper()
+	config.ID = 1
+	config.FileDataName = "agency-"
+	config.Logger = discardLogger()
+	if config.Transport == nil {
+		config.Transport = &PipeTransport{}
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// betServer Fake lottery server for the PipeTransport. As the real one, it
+// stores a chunk once even if the client sends it again after losing its
+// ack, and answers the results query with the draw
+type betServer struct {
+	mutex  sync.Mutex
+	dials  int
+	chunks map[[2]int]bool
+	stored map[int]int
+	// winners Winners of the draw sent to every agency
+	winners []int
+	// ack Returns how many bets of chunk seq, received through the dial-th
+	// connection, are stored and acked. The connection is closed without
+	// acking if drop is true. Every bet is stored and acked if nil
+	ack func(dial int, seq int, bets []*Bet) (count int, drop bool)
+}
+
+// newBetServer Initializes a server that acks chunks as decided by ack
+func newBetServer(ack func(dial int, seq int, bets []*Bet) (int, bool)) *betServer {
+	return &betServer{chunks: make(map[[2]int]bool), stored: make(map[int]int), winners: []int{}, ack: ack}
+}
+
+// serve Answers the messages of a connection until the client closes it
+func (s *betServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mutex.Lock()
+	s.dials++
+	dial := s.dials
+	s.mutex.Unlock()
+
+	decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+	encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+	for {
+		msg, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+		var reply *protocol.Response
+		switch msg.Type {
+		case protocol.MsgBets:
+			count, drop := s.store(dial, msg)
+			if drop {
+				return
+			}
+			reply = &protocol.Response{Kind: protocol.ResponseBatchAck, Count: count, Seq: msg.Seq}
+		case protocol.MsgAwaitResults:
+			reply = &protocol.Response{Kind: protocol.ResponseDrawResult, Draw: &protocol.DrawResult{Winners: s.winners}}
+		default:
+			reply = &protocol.Response{Kind: protocol.ResponseError, Message: "Mensaje no reconocido"}
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: reply.String()}); err != nil {
+			return
+		}
+	}
+}
+
+// store Stores the bets of the chunk that ack accepts, unless the chunk
+// was already stored. Returns the number of bets acked
+func (s *betServer) store(dial int, msg *protocol.Message) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := len(msg.Bets)
+	if s.ack != nil {
+		var drop bool
+		count, drop = s.ack(dial, msg.Seq, msg.Bets)
+		if drop {
+			s.storeOnce(msg.Seq, msg.Bets)
+			return 0, true
+		}
+	}
+	s.storeOnce(msg.Seq, msg.Bets[:count])
+	return count, false
+}
+
+// storeOnce Stores the bets unless the same chunk was already stored
+func (s *betServer) storeOnce(seq int, bets []*Bet) {
+	if len(bets) == 0 {
+		return
+	}
+	key := [2]int{seq, bets[0].PersonalID}
+	if s.chunks[key] {
+		return
+	}
+	s.chunks[key] = true
+	for _, bet := range bets {
+		s.stored[bet.PersonalID]++
+	}
+}
+
+// checkStoredOnce Fails the test unless each of the count bets of
+// writeBetsFile was stored exactly once
+func (s *betServer) checkStoredOnce(t *testing.T, count int) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.stored) != count {
+		t.Fatalf("got %d bets stored, want %d", len(s.stored), count)
+	}
+	for id, times := range s.stored {
+		if times != 1 {
+			t.Fatalf("bet %d stored %d times", id, times)
+		}
+	}
+}
+
+// connections Returns the number of connections opened by the client
+func (s *betServer) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dials
+}
+
+// writeBetsFile Writes count bets in the file of agency id in dir
+func writeBetsFile(t *testing.T, dir string, id int, count int) {
+	t.Helper()
+	var content strings.Builder
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&content, "Name%d,Surname,%d,1990-01-01,%d\n", i, 10000000+i, i)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("agency-%d.csv", id))
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadConfig Returns the config of a client uploading the bets of dir
+// to server in chunks of 2 bets
+func uploadConfig(dir string, server *betServer, window int) ClientConfig {
+	return ClientConfig{
+		DirDataPath:   dir,
+		BetChunkSize:  2,
+		BetWindow:     window,
+		BetMaxRetries: 2,
+		LoopPeriod:    time.Millisecond,
+		ReadTimeout:   5 * time.Second,
+		Transport:     &PipeTransport{Serve: server.serve},
+		Reconnect: ReconnectConfig{
+			InitialDelay: time.Millisecond,
+			Multiplier:   2,
+			MaxAttempts:  3,
+		},
+	}
+}
+
+// writeArchive Writes a zip archive with the given members and returns
+// its path
+func writeArchive(t *testing.T, members map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bets.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for name, content := range members {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode Returns the inode of the file, 0 if it is unknown
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
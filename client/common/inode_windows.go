@@ -0,0 +1,8 @@
+package common
+
+import "os"
+
+// fileInode Returns 0, files have no inode on Windows
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
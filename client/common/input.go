@@ -0,0 +1,133 @@
+package common
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StdinInput Input that reads the bets file from the standard input
+const StdinInput = "-"
+
+// betsFile Bets file of the agency being read, whatever its source. It is
+// read as a stream, so it does not need to be seekable
+type betsFile struct {
+	io.Reader
+	// path Location of the file, used in errors
+	path string
+	// name Name of the CSV file, recorded in the checkpoints
+	name string
+	// closers Released by Close, in reverse order
+	closers []io.Closer
+}
+
+// Close Releases the file. Returns the first failure
+func (f *betsFile) Close() error {
+	var err error
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		if closeErr := f.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	f.closers = nil
+	return err
+}
+
+// IsArchive Returns true if the input is a zip archive, which holds the
+// bets file of every agency
+func IsArchive(input string) bool {
+	return strings.HasSuffix(strings.ToLower(input), ".zip")
+}
+
+// openBetsFile Opens the bets file name from the input, which may be:
+//   - StdinInput, to read it from the standard input
+//   - a zip archive, that is streamed without extracting it. Its member
+//     name is read, whatever its directory in the archive
+//   - a gzip compressed CSV file, if it ends in .gz
+//   - a plain CSV file
+//
+// In case of failure, an InputError is returned
+func openBetsFile(input string, name string) (*betsFile, error) {
+	if input == StdinInput {
+		// The standard input is not closed, it is not owned by the client
+		return &betsFile{Reader: os.Stdin, path: "stdin", name: name}, nil
+	}
+	if IsArchive(input) {
+		return openArchiveMember(input, name)
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, &InputError{Path: input, Err: err}
+	}
+	if !strings.HasSuffix(strings.ToLower(input), ".gz") {
+		return &betsFile{Reader: file, path: input, name: filepath.Base(input), closers: []io.Closer{file}}, nil
+	}
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, &InputError{Path: input, Err: err}
+	}
+	return &betsFile{
+		Reader:  decompressor,
+		path:    input,
+		name:    strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)),
+		closers: []io.Closer{file, decompressor},
+	}, nil
+}
+
+// openArchiveMember Opens the member name of the zip archive
+// In case of failure, an InputError is returned
+func openArchiveMember(archive string, name string) (*betsFile, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, &InputError{Path: archive, Err: err}
+	}
+	for _, member := range reader.File {
+		if path.Base(member.Name) != name || member.FileInfo().IsDir() {
+			continue
+		}
+		content, err := member.Open()
+		if err != nil {
+			reader.Close()
+			return nil, &InputError{Path: archive + ":" + member.Name, Err: err}
+		}
+		return &betsFile{
+			Reader:  content,
+			path:    archive + ":" + member.Name,
+			name:    name,
+			closers: []io.Closer{reader, content},
+		}, nil
+	}
+	reader.Close()
+	return nil, &InputError{Path: archive, Err: fmt.Errorf("%s not found in the archive", name)}
+}
+
+// archiveAgencies Returns the agencies with a bets file in the zip
+// archive, named as in FileDataName
+func archiveAgencies(archive string, fileDataName string) (map[int]bool, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	seen := make(map[int]bool)
+	for _, member := range reader.File {
+		name := path.Base(member.Name)
+		if !strings.HasPrefix(name, fileDataName) || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, fileDataName), ".csv"))
+		if err == nil && id > 0 {
+			seen[id] = true
+		}
+	}
+	return seen, nil
+}
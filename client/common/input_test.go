@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// readBetsFile Opens the bets file name from input and returns its
+// content
+func readBetsFile(t *testing.T, input string, name string) (*betsFile, string) {
+	t.Helper()
+	file, err := openBetsFile(input, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, string(content)
+}
+
+func TestOpenBetsFile(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "agency-1.csv")
+	if err := ioutil.WriteFile(plain, []byte(testBets), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(testBets))
+	writer.Close()
+	gz := filepath.Join(dir, "agency-1.csv.gz")
+	if err := ioutil.WriteFile(gz, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeArchive(t, map[string]string{
+		"data/agency-1.csv": testBets,
+		"data/agency-2.csv": "Eva,Sosa,10000000,2000-12-20,9\n",
+	})
+
+	for _, input := range []string{plain, gz, archive} {
+		file, content := readBetsFile(t, input, "agency-1.csv")
+		if content != testBets {
+			t.Fatalf("%s: got %q", input, content)
+		}
+		if file.name != "agency-1.csv" {
+			t.Fatalf("%s: got name %q", input, file.name)
+		}
+	}
+}
+
+func TestOpenBetsFileFailures(t *testing.T) {
+	dir := t.TempDir()
+	notGzip := filepath.Join(dir, "agency-1.csv.gz")
+	if err := ioutil.WriteFile(notGzip, []byte(testBets), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeArchive(t, map[string]string{"agency-2.csv": ""})
+
+	inputs := []string{filepath.Join(dir, "missing.csv"), notGzip, archive, filepath.Join(dir, "missing.zip")}
+	for _, input := range inputs {
+		_, err := openBetsFile(input, "agency-1.csv")
+		var inputErr *InputError
+		if !errors.As(err, &inputErr) {
+			t.Fatalf("%s: got %v, want an InputError", input, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// link Channel through which a client exchanges messages with the server
+type link interface {
+	// send Encodes the message and writes it whole within timeout (no
+	// limit if 0). The error of ctx is returned if it is done first
+	send(ctx context.Context, msg *protocol.Message, timeout time.Duration) error
+	// receive Returns the next message for the agency, waiting up to
+	// timeout (no limit if 0). A timeout is returned as a net.Error, and
+	// the error of ctx if it is done first
+	receive(ctx context.Context, timeout time.Duration) (*protocol.Message, error)
+	// setCodec Changes the codec used from the next message on
+	setCodec(codec protocol.Codec)
+	// close Releases the link. Closing it again does nothing
+	close() error
+}
+
+// connLink Link over a connection of its own. The connection is closed
+// once, by whichever of the client or the goroutine reading from it
+// closes the link first
+type connLink struct {
+	conn      net.Conn
+	encoder   *protocol.Encoder
+	decoder   *protocol.Decoder
+	closeOnce sync.Once
+}
+
+// newConnLink Initializes a link over the connection
+func newConnLink(conn net.Conn, codec protocol.Codec) *connLink {
+	return &connLink{
+		conn:    conn,
+		encoder: protocol.NewEncoder(conn, codec),
+		decoder: protocol.NewDecoder(conn, codec),
+	}
+}
+
+// send Writes the message with a write deadline
+func (l *connLink) send(ctx context.Context, msg *protocol.Message, timeout time.Duration) error {
+	if err := l.conn.SetWriteDeadline(deadline(timeout)); err != nil {
+		return err
+	}
+	stop := interruptOn(ctx, l.conn.SetDeadline)
+	err := l.encoder.Encode(msg)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// receive Reads the next message with a read deadline
+func (l *connLink) receive(ctx context.Context, timeout time.Duration) (*protocol.Message, error) {
+	if err := l.conn.SetReadDeadline(deadline(timeout)); err != nil {
+		return nil, err
+	}
+	stop := interruptOn(ctx, l.conn.SetDeadline)
+	msg, err := l.decoder.Decode()
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return msg, err
+}
+
+// setCodec Changes the codec of both directions
+func (l *connLink) setCodec(codec protocol.Codec) {
+	l.encoder.SetCodec(codec)
+	l.decoder.SetCodec(codec)
+}
+
+// close Closes the connection the first time it is called
+func (l *connLink) close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.conn.Close()
+	})
+	return err
+}
+
+// interruptOn Makes the pending operations of a connection fail as soon
+// as ctx is done, by moving the deadline set by setDeadline (e.g. the
+// SetDeadline of the connection) to the past. The returned function must
+// be called once the operation finished, it ends the watch so the
+// deadline is not touched afterwards
+func interruptOn(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn Connection that counts how many times it was closed
+type countingConn struct {
+	net.Conn
+	closes int32
+}
+
+// Close Counts the call and closes the connection
+func (c *countingConn) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	return c.Conn.Close()
+}
+
+func TestConnLinkClosesTheConnectionOnce(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := &countingConn{Conn: client}
+	c := newTestClient(t, ClientConfig{})
+	c.link = newConnLink(conn, c.codec)
+
+	// The link is closed to stop a reader goroutine, then the client
+	// releases it
+	for i := 0; i < 2; i++ {
+		if err := c.link.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.closeClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.closeClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	if closes := atomic.LoadInt32(&conn.closes); closes != 1 {
+		t.Fatalf("connection closed %d times, want 1", closes)
+	}
+}
@@ -0,0 +1,287 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// muxStreamBuffer Replies of an agency buffered before the shared
+// connection stops reading
+const muxStreamBuffer = 64
+
+// muxAgencyID Agency announced in the handshake of a multiplexed
+// connection, which belongs to none of the agencies talking through it
+const muxAgencyID = 0
+
+// Mux Connection to the server shared by several agencies, e.g. by a
+// regional hub relaying them. Every agency talks through a stream of the
+// mux, with its own acks and results. The handshake, the wire format and
+// compression are negotiated once for the whole connection, while every
+// agency still signs its messages with its own secret
+type Mux struct {
+	config     ClientConfig
+	logger     logrus.FieldLogger
+	link       *connLink
+	codec      protocol.Codec
+	base       protocol.Codec
+	welcome    *protocol.Welcome
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	streams    map[int]*muxStream
+	err        error
+	closed     chan struct{}
+}
+
+// DialMux Connects to the server and negotiates a multiplexed connection.
+// The config holds the address, TLS, timeouts and protocol options of the
+// connection, its agency ID is not used and the handshake requests
+// signing if any agency of AuthSecrets has a secret. ctx only bounds the dial and the
+// handshake, the connection lives until Close. A ConnectError is returned
+// if the server can not be reached, and a ProtocolError if it does not
+// accept multiplexing or its reply can not be decoded
+func DialMux(ctx context.Context, config ClientConfig) (*Mux, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTransport(ctx, transport, config.ConnectTimeout)
+	if ctx.Err() != nil {
+		return nil, &Canceled{Err: ctx.Err()}
+	}
+	if err != nil {
+		return nil, &ConnectError{Address: transport.String(), Err: err}
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		logTLSState(loggerOf(config), muxAgencyID, tlsConn.ConnectionState())
+	}
+
+	m := &Mux{
+		config:  config,
+		logger:  loggerOf(config),
+		link:    newConnLink(conn, protocol.TextCodec{}),
+		streams: make(map[int]*muxStream),
+		closed:  make(chan struct{}),
+	}
+	if err := m.handshake(ctx); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, &Canceled{Err: ctx.Err()}
+		}
+		return nil, err
+	}
+	go m.readReplies()
+	return m, nil
+}
+
+// handshake Negotiates the connection as in Client.handshake, always
+// requesting multiplexing. The handshake is sent on behalf of no agency,
+// as the server checks the secret of the agency that sends it
+func (m *Mux) handshake(ctx context.Context) error {
+	err := m.link.send(ctx, &protocol.Message{
+		Type:     protocol.MsgHello,
+		AgencyID: muxAgencyID,
+		Versions: protocol.SupportedVersions,
+		Features: append(requestedFeatures(m.config), protocol.FeatureMultiplex),
+	}, m.config.WriteTimeout)
+	if err != nil {
+		return &ConnectError{Address: m.link.conn.RemoteAddr().String(), Err: err}
+	}
+	msg, err := m.link.receive(ctx, m.config.ReadTimeout)
+	var formatErr *protocol.FormatError
+	if errors.As(err, &formatErr) {
+		return &ProtocolError{Err: err}
+	}
+	if err != nil {
+		return &ConnectError{Address: m.link.conn.RemoteAddr().String(), Err: err}
+	}
+	response, err := protocol.ParseResponse(msg.Text)
+	if err != nil {
+		return &ProtocolError{Err: err}
+	}
+	welcome, err := welcomeOf(response)
+	if err != nil {
+		return err
+	}
+	if !welcome.HasFeature(protocol.FeatureMultiplex) {
+		return protocolError("server does not support multiplexed connections")
+	}
+
+	m.codec, m.base = negotiatedCodec(m.config, welcome)
+	m.link.setCodec(m.codec)
+	m.welcome = welcome
+	logHandshake(m.logger, muxAgencyID, welcome)
+	return nil
+}
+
+// NewClient Initializes a client of an agency that talks through a
+// stream of the shared connection
+func (m *Mux) NewClient(config ClientConfig) (*Client, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.mux = m
+	client.welcome = m.welcome
+	client.setCodecs(m.codec, m.base)
+	return client, nil
+}
+
+// Close Closes the shared connection, failing the open streams
+func (m *Mux) Close() error {
+	return m.link.close()
+}
+
+// readReplies Reads the replies of the server and hands every one to the
+// stream of its agency, until the connection fails or is closed
+func (m *Mux) readReplies() {
+	for {
+		msg, err := m.link.receive(context.Background(), 0)
+		if err != nil {
+			m.err = err
+			close(m.closed)
+			return
+		}
+
+		m.mutex.Lock()
+		stream, ok := m.streams[msg.AgencyID]
+		m.mutex.Unlock()
+		if !ok {
+			m.logger.Warnf("action: receive_message | result: fail | client_id: %v | error: reply for an agency without stream: %q",
+				msg.AgencyID,
+				msg.Text,
+			)
+			continue
+		}
+		select {
+		case stream.messages <- msg:
+		case <-stream.done:
+		}
+	}
+}
+
+// open Returns a new stream for the agency, which must not have one open
+func (m *Mux) open(agencyID int, codec protocol.Codec) (*muxStream, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.streams[agencyID]; ok {
+		return nil, fmt.Errorf("agency %d already has a stream", agencyID)
+	}
+	stream := &muxStream{
+		mux:      m,
+		agencyID: agencyID,
+		codec:    codec,
+		messages: make(chan *protocol.Message, muxStreamBuffer),
+		done:     make(chan struct{}),
+	}
+	m.streams[agencyID] = stream
+	return stream, nil
+}
+
+// write Writes a whole encoded message, messages of different streams
+// are never interleaved. If ctx is done while the server does not take
+// the message, the write is interrupted and the shared connection is
+// closed, as the part of the message written would corrupt it
+// This method avoids short-write
+func (m *Mux) write(ctx context.Context, data []byte, timeout time.Duration) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := m.link.conn.SetWriteDeadline(deadline(timeout)); err != nil {
+		return err
+	}
+	stop := interruptOn(ctx, m.link.conn.SetWriteDeadline)
+	defer stop()
+	for written := 0; written < len(data); {
+		n, err := m.link.conn.Write(data[written:])
+		if err != nil && ctx.Err() != nil {
+			m.logger.Errorf("action: send_message | result: fail | client_id: %v | error: write interrupted, closing the shared connection",
+				muxAgencyID,
+			)
+			m.link.close()
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+// muxStream Link of an agency over a Mux
+type muxStream struct {
+	mux      *Mux
+	agencyID int
+	codec    protocol.Codec
+	messages chan *protocol.Message
+	done     chan struct{}
+}
+
+// send Encodes the message with the codec of the agency and writes it
+// to the shared connection
+func (s *muxStream) send(ctx context.Context, msg *protocol.Message, timeout time.Duration) error {
+	data, err := s.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return s.mux.write(ctx, data, timeout)
+}
+
+// receive Returns the next reply for the agency. It fails with
+// net.ErrClosed once the stream is closed
+func (s *muxStream) receive(ctx context.Context, timeout time.Duration) (*protocol.Message, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.mux.closed:
+		// Replies read before the connection failed are still delivered
+		select {
+		case msg := <-s.messages:
+			return msg, nil
+		default:
+			return nil, s.mux.err
+		}
+	case <-s.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// setCodec Changes the codec used to encode the messages of the agency.
+// Replies are decoded by the Mux
+func (s *muxStream) setCodec(codec protocol.Codec) {
+	s.codec = codec
+}
+
+// close Releases the stream, the shared connection stays open. Closing
+// it again does nothing
+func (s *muxStream) close() error {
+	s.mux.mutex.Lock()
+	defer s.mux.mutex.Unlock()
+	if s.mux.streams[s.agencyID] != s {
+		return nil
+	}
+	delete(s.mux.streams, s.agencyID)
+	close(s.done)
+	return nil
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// serveMux Accepts a multiplexed handshake and answers the results query
+// of every agency in replies. Queries are read in pairs, and the replies
+// sent in reverse order
+func serveMux(replies map[int]string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+		encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+		if _, err := decoder.Decode(); err != nil {
+			return
+		}
+		welcome := &protocol.Response{
+			Kind:    protocol.ResponseWelcome,
+			Welcome: &protocol.Welcome{Version: 1, Features: []string{protocol.FeatureMultiplex}},
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: welcome.String()}); err != nil {
+			return
+		}
+		for {
+			var queries []int
+			for len(queries) < 2 {
+				msg, err := decoder.Decode()
+				if err != nil {
+					return
+				}
+				queries = append(queries, msg.AgencyID)
+			}
+			for i := len(queries) - 1; i >= 0; i-- {
+				reply := &protocol.Message{Type: protocol.MsgResponse, AgencyID: queries[i], Text: replies[queries[i]]}
+				if err := encoder.Encode(reply); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// muxClients Dials a Mux through serve and returns a connected client of
+// agencies 1 and 2 over it
+func muxClients(t *testing.T, serve func(conn net.Conn)) (*Client, *Client) {
+	t.Helper()
+	config := ClientConfig{
+		ReadTimeout: 5 * time.Second,
+		Transport:   &PipeTransport{Serve: serve},
+		Logger:      discardLogger(),
+	}
+	mux, err := DialMux(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mux.Close() })
+	var clients []*Client
+	for id := 1; id <= 2; id++ {
+		agencyConfig := config
+		agencyConfig.ID = id
+		client, err := mux.NewClient(agencyConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	return clients[0], clients[1]
+}
+
+// askDraw Sends the results query of the client
+func askDraw(t *testing.T, c *Client) {
+	t.Helper()
+	err := c.sendMessage(context.Background(), &protocol.Message{Type: protocol.MsgAwaitResults, AgencyID: c.config.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxDeliversRepliesToTheirAgency(t *testing.T) {
+	first, second := muxClients(t, serveMux(map[int]string{
+		1: "OK: Sorteo realizado | Ganadores:11",
+		2: "OK: Sorteo realizado | Ganadores:22",
+	}))
+	askDraw(t, first)
+	askDraw(t, second)
+	for want, c := range map[int]*Client{11: first, 22: second} {
+		response, err := c.receiveResponse(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Kind != protocol.ResponseDrawResult || len(response.Draw.Winners) != 1 || response.Draw.Winners[0] != want {
+			t.Fatalf("agency %d got %q", c.config.ID, response)
+		}
+	}
+}
+
+func TestMuxReportsMalformedReplies(t *testing.T) {
+	first, second := muxClients(t, func(conn net.Conn) {
+		serveMux(nil)(&garbledConn{Conn: conn})
+	})
+	askDraw(t, first)
+	askDraw(t, second)
+	_, err := first.receiveResponse(context.Background())
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) || retryable(err) {
+		t.Fatalf("got %v, want a ProtocolError", err)
+	}
+}
+
+// garbledConn Connection whose writes after the handshake carry an agency
+// that is not a number
+type garbledConn struct {
+	net.Conn
+	writes int
+}
+
+// Write Replaces the data written after the first write
+func (c *garbledConn) Write(p []byte) (int, error) {
+	c.writes++
+	if c.writes == 1 {
+		return c.Conn.Write(p)
+	}
+	if _, err := c.Conn.Write([]byte("[AGENCY x] PONG\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestMuxWriteStopsWhenCanceled(t *testing.T) {
+	// The server stops reading after the handshake, and there is no
+	// write timeout
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	first, second := muxClients(t, func(conn net.Conn) {
+		defer conn.Close()
+		decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+		encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+		if _, err := decoder.Decode(); err != nil {
+			return
+		}
+		welcome := &protocol.Response{
+			Kind:    protocol.ResponseWelcome,
+			Welcome: &protocol.Welcome{Version: 1, Features: []string{protocol.FeatureMultiplex}},
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: welcome.String()}); err != nil {
+			return
+		}
+		<-stalled
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- first.sendMessage(ctx, &protocol.Message{Type: protocol.MsgAwaitResults, AgencyID: 1})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write was not interrupted")
+	}
+
+	// The message may have been written in part, the connection is closed
+	// for every agency
+	if _, err := second.receiveResponse(context.Background()); err == nil {
+		t.Fatal("the shared connection was not closed")
+	}
+}
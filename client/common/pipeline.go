@@ -0,0 +1,252 @@
+package common
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// batch Chunk of bets waiting for its acknowledgement. offset and row
+// are the position in the file after its last bet, sent the time it was
+// last sent
+type batch struct {
+	seq      int
+	bets     []*Bet
+	attempts int
+	offset   int64
+	row      int
+	sent     time.Time
+}
+
+// ackResult Reply to a chunk received by readAcks
+type ackResult struct {
+	response *protocol.Response
+	err      error
+}
+
+// readAcks Receives one reply from the server for every chunk announced
+// in expected, until expected is closed or the connection fails. acks is
+// closed on return
+func (c *Client) readAcks(ctx context.Context, expected <-chan struct{}, acks chan<- ackResult) {
+	defer close(acks)
+	for range expected {
+		response, err := c.receiveResponse(ctx)
+		acks <- ackResult{response: response, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendBatch Announces the chunk to readAcks and sends it to the server
+func (c *Client) sendBatch(ctx context.Context, b *batch, expected chan<- struct{}) error {
+	expected <- struct{}{}
+	b.sent = time.Now()
+	return c.sendMessage(ctx, &protocol.Message{
+		Type:     protocol.MsgBets,
+		AgencyID: c.config.ID,
+		Seq:      b.seq,
+		Bets:     b.bets,
+	})
+}
+
+// sendBetsPipelined Sends the bets of the file keeping up to BetWindow
+// chunks in flight, instead of waiting for the ack of every chunk before
+// sending the next one. Chunks are numbered and the acks, read by a
+// separate goroutine, are matched to them by their sequence number. As
+// the server answers in order, the oldest chunk in flight is always the
+// one being acked. Unconfirmed chunks are sent again as in sendBets, and
+// if the connection fails the client reconnects and sends again all the
+// chunks in flight. New chunks are sent as fast as the rate limits allow.
+// The size of the chunks adapts to the time the server takes to ack
+// each one once the chunks before it were acked. The checkpoint is saved after every ack
+// In case of failure, error is returned. The connection is closed then,
+// so the goroutine reading the acks does not outlive the call
+func (c *Client) sendBetsPipelined(ctx context.Context, reader *csv.Reader) (err error) {
+	var expected chan struct{}
+	var acks chan ackResult
+	startAcks := func() {
+		expected = make(chan struct{}, c.config.BetWindow)
+		acks = make(chan ackResult, c.config.BetWindow)
+		go c.readAcks(ctx, expected, acks)
+	}
+	stopAcks := func() {
+		if expected != nil {
+			close(expected)
+			expected = nil
+		}
+	}
+	startAcks()
+	defer func() {
+		// readAcks may be waiting for an ack that will not come
+		if err != nil && c.link != nil {
+			c.link.close()
+		}
+		stopAcks()
+		for range acks {
+		}
+	}()
+
+	inflight := make([]*batch, 0, c.config.BetWindow)
+	failAll := func() {
+		for _, b := range inflight {
+			c.logBets(b.bets, "fail")
+		}
+	}
+	// resume Reconnects and sends again the chunks in flight, in order.
+	// The failed connection is closed first and readAcks is waited for,
+	// so it does not read from the new one
+	resume := func(err error) error {
+		for retryable(err) {
+			c.link.close()
+			stopAcks()
+			for range acks {
+			}
+			if err := c.reconnect(ctx, err); err != nil {
+				return err
+			}
+			startAcks()
+			err = nil
+			for _, b := range inflight {
+				if err = c.sendBatch(ctx, b, expected); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				return nil
+			}
+		}
+		if stopErr := c.stopped(ctx); stopErr != nil {
+			return stopErr
+		}
+		return err
+	}
+
+	// Chunks acked after a chunk that was sent again wait here, the
+	// checkpoint only moves past chunks acked in order
+	acked := make(map[int]*batch)
+	var lastAck time.Time
+	nextSeq := c.progress.Seq + 1
+	row := c.progress.Row
+	end := false
+	for !end || len(inflight) > 0 {
+		if !end && len(inflight) < c.config.BetWindow {
+			bets, eof, err := c.readBets(reader)
+			if err != nil {
+				failAll()
+				return err
+			}
+			end = eof
+			if len(bets) == 0 {
+				end = true
+				continue
+			}
+			row += len(bets)
+			confirmed := c.sendingChunk(nextSeq, len(bets))
+			b := &batch{seq: nextSeq, bets: bets[confirmed:], offset: c.read_offset, row: row}
+			nextSeq++
+			inflight = append(inflight, b)
+			if err := c.throttle(ctx, len(bets)); err != nil {
+				failAll()
+				return err
+			}
+			if err := c.sendBatch(ctx, b, expected); err != nil {
+				if err := resume(err); err != nil {
+					failAll()
+					return err
+				}
+			}
+			continue
+		}
+
+		var result ackResult
+		select {
+		case result = <-acks:
+		case <-ctx.Done():
+			failAll()
+			return c.stopped(ctx)
+		}
+
+		b := inflight[0]
+		err := c.checkAck(b, result)
+		if err == nil {
+			c.backoff.reset()
+			// The time the chunk waited for the acks of the chunks sent
+			// before it is not part of its round trip
+			started := b.sent
+			if started.Before(lastAck) {
+				started = lastAck
+			}
+			c.adjustBatchSize(time.Since(started), len(b.bets))
+			lastAck = time.Now()
+			inflight = inflight[1:]
+			c.logBets(b.bets, "success")
+			acked[b.seq] = b
+			for next, ok := acked[c.progress.Seq+1]; ok; next, ok = acked[c.progress.Seq+1] {
+				delete(acked, next.seq)
+				c.saveCheckpoint(next.offset, next.row, next.seq)
+			}
+			continue
+		}
+		if err := c.stopped(ctx); err != nil {
+			failAll()
+			return err
+		}
+		if retryable(err) {
+			if err := resume(err); err != nil {
+				failAll()
+				return err
+			}
+			continue
+		}
+		if !errors.Is(err, errBatchNotConfirmed) || b.attempts >= c.config.BetMaxRetries {
+			c.logger.Errorf("action: apuestas_enviadas | result: fail | client_id: %v | seq: %v | attempts: %v | error: %v",
+				c.config.ID,
+				b.seq,
+				b.attempts+1,
+				err,
+			)
+			failAll()
+			return err
+		}
+
+		b.attempts++
+		c.logger.Warnf("action: apuestas_enviadas | result: retry | client_id: %v | seq: %v | attempt: %v | error: %v",
+			c.config.ID,
+			b.seq,
+			b.attempts,
+			err,
+		)
+		if confirmed := confirmedBets(result.response, b.seq, len(b.bets)); confirmed > 0 {
+			// Only the bets the server did not store are sent again
+			c.logBets(b.bets[:confirmed], "success")
+			b.bets = b.bets[confirmed:]
+			c.chunkConfirmed(b.seq, confirmed)
+		}
+		inflight = append(inflight[1:], b)
+		if err := c.sendBatch(ctx, b, expected); err != nil {
+			if err := resume(err); err != nil {
+				failAll()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkAck Checks that the reply acknowledges the whole chunk
+func (c *Client) checkAck(b *batch, result ackResult) error {
+	if result.err != nil {
+		return result.err
+	}
+	if err := manageBatchResponse(result.response, len(b.bets)); err != nil {
+		return err
+	}
+	if result.response.Seq != b.seq {
+		return protocolError("received ack of chunk %d while waiting for chunk %d", result.response.Seq, b.seq)
+	}
+	return nil
+}
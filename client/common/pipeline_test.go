@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUploadResendsShortAckedTail(t *testing.T) {
+	for _, window := range []int{1, 3} {
+		t.Run(fmt.Sprintf("window %d", window), func(t *testing.T) {
+			dir := t.TempDir()
+			writeBetsFile(t, dir, 1, 9)
+			shortened := false
+			server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+				if seq == 2 && !shortened {
+					shortened = true
+					return 1, false
+				}
+				return len(bets), false
+			})
+			c := newTestClient(t, uploadConfig(dir, server, window))
+			if err := c.StartClientLoop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			server.checkStoredOnce(t, 9)
+			if c.progress.Seq != 5 {
+				t.Fatalf("got %d chunks acked, want 5", c.progress.Seq)
+			}
+		})
+	}
+}
+
+func TestUploadRebuildsChunksInFlightAfterRestart(t *testing.T) {
+	// The first run stores the first bet of chunk 2 and then loses the
+	// connection, the second one builds larger chunks
+	cases := map[int][][]int{
+		1: {{2, 3}, {3, 4, 5, 6}, {4, 7, 8, 9}},
+		2: {{2, 3}, {3, 4, 5}, {4, 6, 7, 8}, {5, 9}},
+	}
+	for window, want := range cases {
+		t.Run(fmt.Sprintf("window %d", window), func(t *testing.T) {
+			dir := t.TempDir()
+			writeBetsFile(t, dir, 1, 10)
+			var resent [][]int
+			server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+				if dial == 1 {
+					if seq == 1 {
+						return len(bets), false
+					}
+					if seq == 2 && len(bets) == 2 {
+						return 1, false
+					}
+					return 0, true
+				}
+				chunk := []int{seq}
+				for _, bet := range bets {
+					chunk = append(chunk, bet.PersonalID-10000000)
+				}
+				resent = append(resent, chunk)
+				return len(bets), false
+			})
+			config := uploadConfig(dir, server, window)
+			config.CheckpointDir = t.TempDir()
+			config.Reconnect.MaxAttempts = 0
+			c := newTestClient(t, config)
+			if err := c.StartClientLoop(context.Background()); err == nil {
+				t.Fatal("the first run did not fail")
+			}
+			if c.progress.Seq != 1 || len(c.progress.InFlight) != window || c.progress.InFlight[0] != (sentChunk{Bets: 2, Confirmed: 1}) {
+				t.Fatalf("got checkpoint %+v", c.progress)
+			}
+
+			config.BetChunkSize = 3
+			c = newTestClient(t, config)
+			if err := c.StartClientLoop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resent, want) {
+				t.Fatalf("got chunks %v, want %v", resent, want)
+			}
+			server.checkStoredOnce(t, 10)
+		})
+	}
+}
+
+func TestUploadMeasuresRTTFromTheHeadOfTheWindow(t *testing.T) {
+	dir := t.TempDir()
+	writeBetsFile(t, dir, 1, 40)
+	var sizes []int
+	server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+		time.Sleep(20 * time.Millisecond)
+		sizes = append(sizes, len(bets))
+		return len(bets), false
+	})
+	config := uploadConfig(dir, server, 3)
+	config.BetTargetRTT = 50 * time.Millisecond
+	c := newTestClient(t, config)
+	if err := c.StartClientLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Every chunk is acked within the target once it is the oldest in
+	// flight, even if it was sent long before. The last one holds the
+	// rest of the file
+	for i := 1; i < len(sizes)-1; i++ {
+		if sizes[i] < sizes[i-1] {
+			t.Fatalf("chunk sizes shrank: %v", sizes)
+		}
+	}
+	server.checkStoredOnce(t, 40)
+}
@@ -1,151 +1,282 @@
 package common
 
 import (
-	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"net"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
 )
 
-// sendMessage Sends a message to the server
-// In case of failure, error is returned
+// sendMessage Encodes a message and sends it to the server. The whole
+// message must be written within WriteTimeout
+// In case of failure, error is returned. Failures of the connection wrap
+// errConnectionFailed or errTimeout, and the error of ctx is returned if
+// it is done first
 // This method avoids short-write
-func (c *Client) sendMessage(msg string) error {
-    msgBytes := []byte(fmt.Sprintf("%s\n", msg))
-
-    totalSent := 0
-    writeErr := make(chan error, 1)
-    go func() {
-        for totalSent < len(msgBytes) {
-            sent, err := c.conn.Write(msgBytes[totalSent:])
-            if err != nil {
-                log.Fatalf("action: send_message | result: fail | client_id: %v | error: %v",
-                    c.config.ID,
-                    err,
-                )
-                c.StopClient()
-                writeErr <- err
-                return
-            }
-            totalSent += sent
-        }
-        writeErr <- nil
-    }()
-
-    select {
-    case <-c.stop_chan:
-        return fmt.Errorf("stopped by user")
-    case err := <-writeErr:
-        if err != nil {
-            return err
-        }
-    }
-
-    return nil
+func (c *Client) sendMessage(ctx context.Context, msg *protocol.Message) error {
+	err := c.link.send(ctx, msg, c.config.WriteTimeout)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if isTimeout(err) {
+		return fmt.Errorf("%w: message not sent within %v", errTimeout, c.config.WriteTimeout)
+	}
+	return fmt.Errorf("%w: %v", errConnectionFailed, err)
 }
 
-// receiveMessage Receives a message from the server
-// In case of failure, error is returned
+// receiveMessage Receives a message from the server and returns the text
+// of the reply. The reply must arrive within timeout (no limit if 0)
+// In case of failure, error is returned. Failures of the connection wrap
+// errConnectionFailed or errTimeout, and the error of ctx is returned if
+// it is done first. A reply that can not be decoded is a ProtocolError
 // This method avoids short-reads
-func (c *Client) receiveMessage() (string, error) {
-    var message bytes.Buffer
-    data := make([]byte, 1024)
-
-    readErr := make(chan error, 1)
-    go func() {
-        for {
-            n, err := c.conn.Read(data)
-            if err != nil {
-                if err == io.EOF {
-                    break
-                }
-                log.Fatalf("action: receive_message | result: fail | client_id: %v | error: %v",
-                    c.config.ID,
-                    err,
-                )
-                c.StopClient()
-                readErr <- err
-                return
-            }
-            message.Write(data[:n])
-            if bytes.HasSuffix(message.Bytes(), []byte{'\n'}) {
-                break
-            }
-        }
-        readErr <- nil
-    }()
-
-    select {
-    case <-c.stop_chan:
-        return "", fmt.Errorf("stopped by user")
-    case err := <-readErr:
-        if err != nil {
-            return "", err
-        }
-    }
-
-    return strings.TrimSuffix(message.String(), "\n"), nil
+func (c *Client) receiveMessage(ctx context.Context, timeout time.Duration) (string, error) {
+	msg, err := c.link.receive(ctx, timeout)
+	if err != nil && ctx.Err() != nil {
+		return "", err
+	}
+	if isTimeout(err) {
+		return "", fmt.Errorf("%w: no reply within %v", errTimeout, timeout)
+	}
+	if err == io.EOF {
+		return "", fmt.Errorf("%w: closed by server", errConnectionFailed)
+	}
+	var formatErr *protocol.FormatError
+	if errors.As(err, &formatErr) {
+		return "", &ProtocolError{Err: err}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errConnectionFailed, err)
+	}
+
+	if msg.Type != protocol.MsgResponse {
+		return "", protocolError("unexpected message type from server: %d", msg.Type)
+	}
+	return msg.Text, nil
+}
+
+// receiveResponse Receives a reply from the server within ReadTimeout
+// and parses it
+// In case of failure or an unknown reply, error is returned
+func (c *Client) receiveResponse(ctx context.Context) (*protocol.Response, error) {
+	return c.receiveResponseWithin(ctx, c.config.ReadTimeout)
 }
 
-// sendBets Sends a list of bets to the server
-// In case of failure, true is returned
-func sendBets(c *Client, bets []*Bet) bool {
-	betStrings := make([]string, len(bets))
-	for i, bet := range bets {
-		betStrings[i] = bet.ToStr()
+// receiveResponseWithin Receives a reply from the server within timeout
+// and parses it
+// In case of failure, error is returned. An unknown reply is returned as
+// a ProtocolError
+func (c *Client) receiveResponseWithin(ctx context.Context, timeout time.Duration) (*protocol.Response, error) {
+	reply, err := c.receiveMessage(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, protocolError("empty message")
+	}
+	response, err := protocol.ParseResponse(reply)
+	if err != nil {
+		return nil, &ProtocolError{Err: err}
+	}
+	return response, nil
+}
+
+// errTimeout The server did not answer or accept a message in time
+var errTimeout = errors.New("timeout")
+
+// deadline Returns the deadline of an operation that must finish within
+// timeout. A zero timeout means no deadline
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
 	}
-	joinedBets := strings.Join(betStrings, "")
+	return time.Now().Add(timeout)
+}
+
+// isTimeout Returns true if err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
-	message := fmt.Sprintf(
-		"[CLIENT %v] Bets -> %s",
-		c.config.ID,
-		joinedBets,
-	)
-	err := c.sendMessage(message)
+// errBatchNotConfirmed The server did not acknowledge the whole chunk of bets
+var errBatchNotConfirmed = errors.New("chunk of bets not confirmed")
 
+// sendBets Sends a list of bets to the server as chunk seq and waits for
+// its acknowledgement. A chunk that is not confirmed (the server acked a
+// different amount of bets or did not ack it) is sent again up to
+// BetMaxRetries times, waiting the loop period between attempts. If the
+// server acked only the first bets of the chunk, only the rest are sent
+// again, with the same seq. If the
+// connection fails the client reconnects and sends the chunk again, as
+// its ack may have been lost; the server does not store again a chunk
+// whose seq it already acked. Bets are only logged as successful once
+// the server confirmed them
+// In case of failure, error is returned
+func sendBets(ctx context.Context, c *Client, seq int, bets []*Bet) error {
+	for attempt := 0; ; attempt++ {
+		confirmed, err := c.sendBetsOnce(ctx, seq, bets)
+		if err == nil {
+			c.backoff.reset()
+			c.logBets(bets, "success")
+			return nil
+		}
+		if err := c.stopped(ctx); err != nil {
+			c.logBets(bets, "fail")
+			return err
+		}
+		if retryable(err) {
+			if err := c.reconnect(ctx, err); err != nil {
+				c.logBets(bets, "fail")
+				return err
+			}
+			// Reconnections are not attempts to confirm the chunk
+			attempt--
+			continue
+		}
+		if !errors.Is(err, errBatchNotConfirmed) || attempt >= c.config.BetMaxRetries {
+			c.logger.Errorf("action: apuestas_enviadas | result: fail | client_id: %v | attempts: %v | error: %v",
+				c.config.ID,
+				attempt+1,
+				err,
+			)
+			c.logBets(bets, "fail")
+			return err
+		}
+		c.logger.Warnf("action: apuestas_enviadas | result: retry | client_id: %v | attempt: %v | error: %v",
+			c.config.ID,
+			attempt+1,
+			err,
+		)
+		if confirmed > 0 {
+			// Only the bets the server did not store are sent again
+			c.logBets(bets[:confirmed], "success")
+			bets = bets[confirmed:]
+			c.chunkConfirmed(seq, confirmed)
+		}
+		if err := c.waitOrStop(ctx); err != nil {
+			c.logBets(bets, "fail")
+			return err
+		}
+	}
+}
+
+// sendBetsOnce Sends a list of bets to the server as chunk seq and checks
+// its reply. The time the server took to ack the chunk adjusts the size
+// of the next ones. Returns the number of bets the server acked, see
+// confirmedBets
+func (c *Client) sendBetsOnce(ctx context.Context, seq int, bets []*Bet) (int, error) {
+	start := time.Now()
+	err := c.sendMessage(ctx, &protocol.Message{
+		Type:     protocol.MsgBets,
+		AgencyID: c.config.ID,
+		Seq:      seq,
+		Bets:     bets,
+	})
 	if err != nil {
-		logBets(bets, "fail")
-		c.StopClient()
-		return true
+		return 0, err
 	}
 
-	logBets(bets, "success")
-	return false
+	response, err := c.receiveResponse(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := manageBatchResponse(response, len(bets)); err != nil {
+		return confirmedBets(response, seq, len(bets)), err
+	}
+	if response.Seq != seq {
+		return 0, protocolError("received ack of chunk %d while waiting for chunk %d", response.Seq, seq)
+	}
+	c.adjustBatchSize(time.Since(start), len(bets))
+	return len(bets), nil
 }
 
-// readBets Reads a chunk of bets from the file
-// In case of failure, true is returned
-func (c *Client) readBets(reader *csv.Reader) ([]*Bet, bool, bool) {
-	bets := make([]*Bet, 0, c.config.BetChunkSize)
-	end := false
-	for i := 0; i < c.config.BetChunkSize; i++ {
-		bet, err := readBet(c.config.ID, reader)
+// readBets Reads the next chunk of bets from the file, as many as the
+// batchSizer allows. A bet that does not fit in the chunk is kept for the
+// next one. Returns true if the end of the file was reached, read_offset
+// is left at the position in the file after the last bet of the chunk.
+// The chunks of resend are built with the same number of bets they had
+// In case of failure, an InputError is returned
+func (c *Client) readBets(reader *csv.Reader) ([]*Bet, bool, error) {
+	rebuilt := -1
+	if len(c.resend) > 0 {
+		rebuilt = c.resend[0].Bets
+		c.resend = c.resend[1:]
+	}
+	chunk := &chunkBuilder{bets: make([]*Bet, 0, c.sizer.size)}
+	for {
+		bet, end, err := c.nextBet(reader)
 		if err == io.EOF {
-			end = true
-			break
+			return chunk.bets, true, nil
+		}
+		added := false
+		if err == nil && rebuilt >= 0 {
+			added = len(chunk.bets) < rebuilt
+			if added {
+				chunk.bets = append(chunk.bets, bet)
+			}
+		} else if err == nil {
+			added, err = c.sizer.add(c.plain_codec, c.size_codec, chunk, bet)
 		}
 		if err != nil {
-			log.Infof("action: read_bet | result: fail | client_id: %v | error: %v",
+			c.logger.Infof("action: read_bet | result: fail | client_id: %v | error: %v",
 				c.config.ID,
 				err,
 			)
-			c.StopClient()
-			return nil, false, true
+			return nil, false, &InputError{Path: c.data_file.path, Err: err}
 		}
-		bets = append(bets, bet)
-		c.personal_ids[bet.GetPersonalID()] = true
+		if !added {
+			c.pending, c.pending_end = bet, end
+			return chunk.bets, false, nil
+		}
+		c.read_offset = end
+		c.uploaded_bets[bet.GetPersonalID()] = append(c.uploaded_bets[bet.GetPersonalID()], bet)
 	}
-	return bets, end, false
 }
 
-// getWinners Gets the winners from the server
-// In case of failure, true is returned
-func (c *Client) getWinners(result string) {
-	winners := strings.Split(strings.Split(result, ":")[2], ",")
-	log.Infof("action: consulta_ganadores | result: success | cant_ganadores: %v",
-		len(winners),
-	)
+// nextBet Returns the bet kept by readBets, or reads the next one from
+// the file, along with the position in the file after it
+func (c *Client) nextBet(reader *csv.Reader) (*Bet, int64, error) {
+	if bet := c.pending; bet != nil {
+		c.pending = nil
+		return bet, c.pending_end, nil
+	}
+	bet, err := readBet(c.config.ID, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bet, c.data_reader.offset, nil
+}
+
+// confirmedBets Returns how many of the first bets of chunk seq the
+// server acked if it did not ack the whole chunk, 0 if the reply is not
+// a short ack of the chunk
+func confirmedBets(response *protocol.Response, seq int, sent int) int {
+	if response == nil || response.Kind != protocol.ResponseBatchAck || response.Seq != seq ||
+		response.Count < 0 || response.Count >= sent {
+		return 0
+	}
+	return response.Count
+}
+
+// manageBatchResponse Checks the server reply to a chunk of sent bets
+// A ServerRejected error is returned if the server rejected the chunk,
+// and a ProtocolError wrapping errBatchNotConfirmed if it acked a
+// different amount of bets or replied something else
+func manageBatchResponse(response *protocol.Response, sent int) error {
+	switch response.Kind {
+	case protocol.ResponseBatchAck:
+		if response.Count != sent {
+			return protocolError("%w: sent %d bets, server acked %d", errBatchNotConfirmed, sent, response.Count)
+		}
+		return nil
+	case protocol.ResponseError:
+		return rejected(response)
+	}
+	return protocolError("%w: unexpected %v reply", errBatchNotConfirmed, response.Kind)
 }
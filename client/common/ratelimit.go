@@ -0,0 +1,58 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter Spaces the chunks of bets so the upload does not exceed
+// BetsPerSecond nor BatchesPerSecond (no limit if 0). Unlike a fixed
+// sleep between chunks, a chunk is only delayed if sending it right away
+// would exceed the rates
+type rateLimiter struct {
+	betsPerSecond    float64
+	batchesPerSecond float64
+	// next Earliest time the next chunk may be sent
+	next time.Time
+}
+
+// newRateLimiter Initializes the limiter of the rates of the config
+func newRateLimiter(config ClientConfig) *rateLimiter {
+	return &rateLimiter{
+		betsPerSecond:    config.BetsPerSecond,
+		batchesPerSecond: config.BatchesPerSecond,
+		next:             time.Time{},
+	}
+}
+
+// reserve Books the sending of a chunk of count bets and returns how long
+// the caller must wait before sending it
+func (r *rateLimiter) reserve(count int) time.Duration {
+	var cost time.Duration
+	if r.betsPerSecond > 0 {
+		cost = time.Duration(float64(count) / r.betsPerSecond * float64(time.Second))
+	}
+	if r.batchesPerSecond > 0 {
+		if batchCost := time.Duration(float64(time.Second) / r.batchesPerSecond); batchCost > cost {
+			cost = batchCost
+		}
+	}
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(cost)
+	return delay
+}
+
+// throttle Waits until a chunk of count bets can be sent without
+// exceeding the configured rates
+// In case the client should stop, a Canceled error is returned
+func (c *Client) throttle(ctx context.Context, count int) error {
+	delay := c.limiter.reserve(count)
+	if delay <= 0 {
+		return nil
+	}
+	return c.waitFor(ctx, delay)
+}
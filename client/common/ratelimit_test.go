@@ -0,0 +1,43 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	cases := map[string]struct {
+		config ClientConfig
+		count  int
+		delay  time.Duration
+	}{
+		"no limit": {ClientConfig{}, 10, 0},
+		"bets":     {ClientConfig{BetsPerSecond: 100}, 10, 100 * time.Millisecond},
+		"batches":  {ClientConfig{BatchesPerSecond: 5}, 10, 200 * time.Millisecond},
+		"slowest":  {ClientConfig{BetsPerSecond: 100, BatchesPerSecond: 5}, 50, 500 * time.Millisecond},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			limiter := newRateLimiter(c.config)
+			if delay := limiter.reserve(c.count); delay != 0 {
+				t.Fatalf("first chunk delayed %v", delay)
+			}
+			delay := limiter.reserve(c.count)
+			// Some time passes between both reservations
+			if delay > c.delay || delay < c.delay-50*time.Millisecond {
+				t.Fatalf("got delay %v, want %v", delay, c.delay)
+			}
+		})
+	}
+}
+
+func TestRateLimiterDoesNotSaveUnusedTime(t *testing.T) {
+	limiter := newRateLimiter(ClientConfig{BatchesPerSecond: 100})
+	limiter.reserve(1)
+	time.Sleep(50 * time.Millisecond)
+	// The idle time is not spent on a burst of chunks
+	limiter.reserve(1)
+	if delay := limiter.reserve(1); delay <= 0 {
+		t.Fatalf("got delay %v after a pause", delay)
+	}
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// errConnectionFailed The connection to the server could not be opened,
+// broke or was closed by the server
+var errConnectionFailed = errors.New("connection to the server failed")
+
+// ReconnectConfig Policy followed to dial the server again when the
+// connection fails. The n-th attempt waits InitialDelay * Multiplier^n,
+// at most MaxDelay (no limit if 0), randomly moved up to Jitter (a
+// fraction between 0 and 1) of it so agencies do not dial all at once.
+// The client gives up after MaxAttempts attempts in a row, reconnecting
+// is disabled if it is 0
+type ReconnectConfig struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	MaxAttempts  int
+	Jitter       float64
+}
+
+// backoff Delays between the reconnection attempts of a client
+type backoff struct {
+	config  ReconnectConfig
+	attempt int
+	random  *rand.Rand
+}
+
+// newBackoff Initializes the delays of the given policy
+func newBackoff(config ReconnectConfig) *backoff {
+	return &backoff{
+		config:  config,
+		attempt: 0,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next Returns the delay before the next attempt. False is returned if
+// MaxAttempts attempts were already made
+func (b *backoff) next() (time.Duration, bool) {
+	if b.attempt >= b.config.MaxAttempts {
+		return 0, false
+	}
+	multiplier := math.Max(b.config.Multiplier, 1)
+	delay := float64(b.config.InitialDelay) * math.Pow(multiplier, float64(b.attempt))
+	if b.config.MaxDelay > 0 {
+		delay = math.Min(delay, float64(b.config.MaxDelay))
+	}
+	jitter := math.Min(math.Max(b.config.Jitter, 0), 1)
+	delay *= 1 + jitter*(2*b.random.Float64()-1)
+	b.attempt++
+	return time.Duration(delay), true
+}
+
+// reset Starts counting the attempts again, once the client made
+// progress over the connection
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// retryable Returns true if the error is a failure of the connection,
+// which a new connection may overcome
+func retryable(err error) bool {
+	return errors.Is(err, errConnectionFailed) ||
+		errors.Is(err, errTimeout) ||
+		errors.Is(err, errPeerUnresponsive)
+}
+
+// dial Opens the connection to the server and runs the handshake on it
+func (c *Client) dial(ctx context.Context) error {
+	err := c.createClientSocket(ctx)
+	if err != nil {
+		return err
+	}
+	// Streams of a Mux use the handshake of the shared connection
+	if c.config.Handshake && c.mux == nil {
+		err = c.handshake(ctx)
+		if err != nil {
+			c.closeClientSocket()
+			return err
+		}
+	}
+	return nil
+}
+
+// connect Connects to the server, which may not be up yet. Failed
+// attempts are retried as in reconnect
+// In case of failure, error is returned
+func (c *Client) connect(ctx context.Context) error {
+	err := c.dial(ctx)
+	if err == nil {
+		return nil
+	}
+	return c.reconnect(ctx, err)
+}
+
+// connectError Returns the ConnectError of a connection that could not
+// be opened again
+func (c *Client) connectError(err error) error {
+	return &ConnectError{Address: c.transport.String(), Err: err}
+}
+
+// reconnect Closes the failed connection and dials the server again,
+// waiting the delay of the reconnect policy before every attempt. The
+// caller resumes from its last acknowledged message. Streams of a Mux
+// are not reconnected, the shared connection failed for all of them
+// The client does not reconnect once ctx is done
+// In case of failure, error is returned: a ConnectError if the client
+// gave up reconnecting, a Canceled error if ctx is done, or the cause if
+// it is not a failure of the connection
+func (c *Client) reconnect(ctx context.Context, cause error) error {
+	c.closeClientSocket()
+	if err := c.stopped(ctx); err != nil {
+		return err
+	}
+	if !retryable(cause) || c.mux != nil || c.config.Reconnect.MaxAttempts <= 0 {
+		c.logger.Errorf("action: connect | result: fail | client_id: %v | address: %v | error: %v",
+			c.config.ID,
+			c.transport,
+			cause,
+		)
+		if !retryable(cause) {
+			return cause
+		}
+		return c.connectError(cause)
+	}
+
+	err := cause
+	for {
+		delay, ok := c.backoff.next()
+		if !ok {
+			c.logger.Errorf("action: reconnect | result: fail | client_id: %v | attempts: %v | error: %v",
+				c.config.ID,
+				c.backoff.attempt,
+				err,
+			)
+			return c.connectError(err)
+		}
+		c.logger.Warnf("action: reconnect | result: in_progress | client_id: %v | attempt: %v | delay: %v | error: %v",
+			c.config.ID,
+			c.backoff.attempt,
+			delay,
+			err,
+		)
+		if err := c.waitFor(ctx, delay); err != nil {
+			return err
+		}
+
+		err = c.dial(ctx)
+		if err == nil {
+			c.logger.Infof("action: reconnect | result: success | client_id: %v | attempt: %v",
+				c.config.ID,
+				c.backoff.attempt,
+			)
+			return nil
+		}
+		if err := c.stopped(ctx); err != nil {
+			return err
+		}
+		if !retryable(err) {
+			c.logger.Errorf("action: reconnect | result: fail | client_id: %v | attempts: %v | error: %v",
+				c.config.ID,
+				c.backoff.attempt,
+				err,
+			)
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUploadReconnectsAfterLostAck(t *testing.T) {
+	for _, window := range []int{1, 3} {
+		t.Run(fmt.Sprintf("window %d", window), func(t *testing.T) {
+			dir := t.TempDir()
+			writeBetsFile(t, dir, 1, 9)
+			server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+				return len(bets), dial == 1 && seq == 2
+			})
+			c := newTestClient(t, uploadConfig(dir, server, window))
+			if err := c.StartClientLoop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			server.checkStoredOnce(t, 9)
+			if dials := server.connections(); dials != 2 {
+				t.Fatalf("got %d connections, want 2", dials)
+			}
+		})
+	}
+}
+
+func TestUploadGivesUpReconnecting(t *testing.T) {
+	dir := t.TempDir()
+	writeBetsFile(t, dir, 1, 3)
+	server := newBetServer(func(dial int, seq int, bets []*Bet) (int, bool) {
+		return 0, true
+	})
+	c := newTestClient(t, uploadConfig(dir, server, 1))
+	err := c.StartClientLoop(context.Background())
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("got %v, want a ConnectError", err)
+	}
+	if dials := server.connections(); dials != 4 {
+		t.Fatalf("got %d connections, want 4", dials)
+	}
+}
+
+func TestBackoffDelays(t *testing.T) {
+	b := newBackoff(ReconnectConfig{
+		InitialDelay: 10 * time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     30 * time.Millisecond,
+		MaxAttempts:  4,
+	})
+	want := []time.Duration{10, 20, 30, 30}
+	for i, delay := range want {
+		got, ok := b.next()
+		if !ok || got != delay*time.Millisecond {
+			t.Fatalf("attempt %d: got %v, %v, want %v", i, got, ok, delay*time.Millisecond)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Fatal("got a delay after MaxAttempts attempts")
+	}
+	b.reset()
+	if got, ok := b.next(); !ok || got != 10*time.Millisecond {
+		t.Fatalf("got %v, %v after reset", got, ok)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(ReconnectConfig{InitialDelay: 100 * time.Millisecond, Multiplier: 1, MaxAttempts: 50, Jitter: 0.5})
+	for i := 0; i < 50; i++ {
+		delay, _ := b.next()
+		if delay < 50*time.Millisecond || delay > 150*time.Millisecond {
+			t.Fatalf("attempt %d: got %v, out of the jitter", i, delay)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Receipt Acknowledgement of the bets submitted in a call to Submit
+type Receipt struct {
+	// Bets Number of bets stored by the server
+	Bets int
+	// Chunks Number of messages in which they were sent
+	Chunks int
+}
+
+// DrawResult Result of the draw for the agency of a Session
+type DrawResult struct {
+	// Winners Personal IDs (DNI) of the winners that bet in the agency
+	Winners []int
+	// WinningBets Bets submitted in the session by the winners
+	WinningBets []Bet
+	// Unknown Winners that do not match any bet submitted in the session
+	Unknown []int
+}
+
+// Session Connection of an agency to the server, for software that
+// submits its bets directly instead of through the bets file of the
+// client. It follows the config as the client does: chunks of bets are
+// sized by BetChunkSize, BetMaxBytes and BetTargetRTT and failed
+// connections are reopened according to Reconnect. Logs go to
+// config.Logger, and are discarded if it is nil
+// A Session must not be used by several goroutines at once
+type Session struct {
+	client *Client
+}
+
+// Dial Connects the agency config.ID to the server and runs the handshake
+// In case of failure, error is returned, a ConnectError if the server
+// could not be reached
+func Dial(ctx context.Context, config ClientConfig) (*Session, error) {
+	if config.Logger == nil {
+		logger := logrus.New()
+		logger.Out = ioutil.Discard
+		config.Logger = logger
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.connect(ctx); err != nil {
+		return nil, err
+	}
+	return &Session{client: client}, nil
+}
+
+// Submit Sends the bets of the agency to the server, in chunks sized as
+// the ones of the bets file, waiting for the ack of every chunk. The
+// agency of the bets is set to the one of the session
+// In case of failure, error is returned along with the receipt of the
+// chunks acknowledged before it. An InputError is returned if a bet does
+// not fit in BetMaxBytes
+func (s *Session) Submit(ctx context.Context, bets []Bet) (Receipt, error) {
+	c := s.client
+	receipt := Receipt{}
+	for next := 0; next < len(bets); {
+		chunk := &chunkBuilder{bets: make([]*Bet, 0, c.sizer.size)}
+		for ; next < len(bets); next++ {
+			bet := bets[next]
+			bet.AgencyID = c.config.ID
+			added, err := c.sizer.add(c.plain_codec, c.size_codec, chunk, &bet)
+			if err != nil {
+				return receipt, &InputError{Err: err}
+			}
+			if !added {
+				break
+			}
+		}
+
+		if err := c.throttle(ctx, len(chunk.bets)); err != nil {
+			return receipt, err
+		}
+		if err := sendBets(ctx, c, c.progress.Seq+1, chunk.bets); err != nil {
+			return receipt, err
+		}
+		c.progress.Seq++
+		for _, bet := range chunk.bets {
+			c.uploaded_bets[bet.GetPersonalID()] = append(c.uploaded_bets[bet.GetPersonalID()], bet)
+		}
+		receipt.Bets += len(chunk.bets)
+		receipt.Chunks++
+	}
+	return receipt, nil
+}
+
+// MarkDone Tells the server that the agency submitted all its bets, so it
+// makes the draw once every agency is done. If the draw was already made
+// its result is kept for AwaitDraw
+// In case of failure, error is returned
+func (s *Session) MarkDone(ctx context.Context) error {
+	c := s.client
+	for {
+		_, err := c.askResults(ctx)
+		if err := c.stopped(ctx); err != nil {
+			return err
+		}
+		if !retryable(err) {
+			if err == nil {
+				c.backoff.reset()
+			}
+			return err
+		}
+		if err := c.reconnect(ctx, err); err != nil {
+			return err
+		}
+	}
+}
+
+// AwaitDraw Blocks until the server makes the draw and returns its
+// result for the agency, matched with the bets submitted in the session.
+// The agency is marked as done if MarkDone was not called. The results
+// are awaited with a subscription if the server accepted it, otherwise
+// they are asked for every LoopPeriod
+// In case of failure, error is returned
+func (s *Session) AwaitDraw(ctx context.Context) (DrawResult, error) {
+	c := s.client
+	if c.draw == nil {
+		var err error
+		if c.subscribed() {
+			err = c.subscribeResults(ctx)
+		} else {
+			err = c.pollResults(ctx)
+		}
+		if err != nil {
+			return DrawResult{}, err
+		}
+	}
+
+	winningBets, unknown := c.checkWinners(c.draw)
+	result := DrawResult{
+		Winners:     c.draw.Winners,
+		WinningBets: make([]Bet, 0, len(winningBets)),
+		Unknown:     unknown,
+	}
+	for _, bet := range winningBets {
+		result.WinningBets = append(result.WinningBets, *bet)
+	}
+	return result, nil
+}
+
+// Close Closes the connection to the server
+func (s *Session) Close() error {
+	return s.client.closeClientSocket()
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	server := newBetServer(nil)
+	server.winners = []int{10000001, 99999999}
+	session, err := Dial(context.Background(), ClientConfig{
+		ID:           1,
+		BetChunkSize: 2,
+		ReadTimeout:  5 * time.Second,
+		Transport:    &PipeTransport{Serve: server.serve},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var bets []Bet
+	for i := 0; i < 5; i++ {
+		bets = append(bets, Bet{ID: i, Name: "Ana", Surname: "Paz", PersonalID: 10000000 + i, BirthDate: "1999-03-17"})
+	}
+	receipt, err := session.Submit(context.Background(), bets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt != (Receipt{Bets: 5, Chunks: 3}) {
+		t.Fatalf("got receipt %+v", receipt)
+	}
+	server.checkStoredOnce(t, 5)
+
+	if err := session.MarkDone(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	result, err := session.AwaitDraw(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.WinningBets) != 1 || result.WinningBets[0].ID != 1 || result.WinningBets[0].AgencyID != 1 {
+		t.Fatalf("got winning bets %+v", result.WinningBets)
+	}
+	if !reflect.DeepEqual(result.Unknown, []int{99999999}) {
+		t.Fatalf("got unknown winners %v", result.Unknown)
+	}
+}
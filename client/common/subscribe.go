@@ -0,0 +1,147 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// subscribed Returns true if the results are awaited with a single
+// subscription, which needs the server to accept it in the handshake
+func (c *Client) subscribed() bool {
+	return c.config.Subscribe &&
+		c.welcome != nil &&
+		c.welcome.HasFeature(protocol.FeatureSubscribe)
+}
+
+// readResponses Receives replies from the server until the draw result,
+// a failure or done is closed. responses is closed on return
+func (c *Client) readResponses(ctx context.Context, responses chan<- ackResult, done <-chan struct{}) {
+	defer close(responses)
+	for {
+		response, err := c.receiveResponseWithin(ctx, 0)
+		select {
+		case responses <- ackResult{response: response, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil || response.Kind == protocol.ResponseDrawResult {
+			return
+		}
+	}
+}
+
+// subscribeResults Subscribes to the results of the agency and blocks
+// until the server pushes them after the draw. While waiting, the server
+// is pinged every HeartbeatInterval if it accepted heartbeats, and the
+// wait is abandoned after SubscribeTimeout (no limit if 0). If the
+// connection fails the client reconnects and subscribes again
+// In case of failure, error is returned
+func (c *Client) subscribeResults(ctx context.Context) error {
+	for {
+		err := c.sendMessage(ctx, &protocol.Message{
+			Type:     protocol.MsgSubscribe,
+			AgencyID: c.config.ID,
+		})
+		if err == nil {
+			c.logger.Infof("action: consulta_ganadores | result: in_progress | client_id: %v | msg: subscribed",
+				c.config.ID,
+			)
+			err = c.awaitDraw(ctx)
+		}
+		if err == nil {
+			return nil
+		}
+		if err := c.stopped(ctx); err != nil {
+			return err
+		}
+		if retryable(err) {
+			if err = c.reconnect(ctx, err); err == nil {
+				continue
+			}
+		}
+		c.logger.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
+	}
+}
+
+// awaitDraw Waits for the draw result pushed by the server, checking
+// with heartbeats that the server is still alive
+func (c *Client) awaitDraw(ctx context.Context) (err error) {
+	responses := make(chan ackResult)
+	done := make(chan struct{})
+	go c.readResponses(ctx, responses, done)
+	// readResponses is waited for, so it never reads from a later
+	// connection. On failure the connection is closed to unblock it
+	defer func() {
+		if err != nil {
+			c.link.close()
+		}
+		close(done)
+		for range responses {
+		}
+	}()
+
+	var heartbeat <-chan time.Time
+	if c.heartbeats() {
+		ticker := time.NewTicker(c.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var deadline <-chan time.Time
+	if c.config.SubscribeTimeout > 0 {
+		timer := time.NewTimer(c.config.SubscribeTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// pongTimeout Fires if the pending ping was not answered in time
+	pinged := false
+	var pongTimeout <-chan time.Time
+
+	for {
+		select {
+		case result := <-responses:
+			if result.err != nil {
+				return result.err
+			}
+			switch result.response.Kind {
+			case protocol.ResponsePong:
+				c.backoff.reset()
+				pinged = false
+				pongTimeout = nil
+				c.logger.Debugf("action: heartbeat | result: success | client_id: %v", c.config.ID)
+			case protocol.ResponseDrawResult:
+				c.getWinners(result.response.Draw)
+				return nil
+			case protocol.ResponseError:
+				return rejected(result.response)
+			default:
+				return protocolError("unexpected %v reply to a subscription", result.response.Kind)
+			}
+		case <-heartbeat:
+			if pinged {
+				continue
+			}
+			err := c.sendMessage(ctx, &protocol.Message{Type: protocol.MsgPing, AgencyID: c.config.ID})
+			if err != nil {
+				return fmt.Errorf("%w: %v", errPeerUnresponsive, err)
+			}
+			pinged = true
+			if c.config.HeartbeatTimeout > 0 {
+				pongTimeout = time.After(c.config.HeartbeatTimeout)
+			}
+		case <-pongTimeout:
+			return fmt.Errorf("%w: no reply within %v", errPeerUnresponsive, c.config.HeartbeatTimeout)
+		case <-deadline:
+			// Not a failure of the connection, the client does not reconnect
+			return &Canceled{Err: fmt.Errorf("draw not received within %v", c.config.SubscribeTimeout)}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
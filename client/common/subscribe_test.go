@@ -0,0 +1,116 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// subscribeServer Fake server that pushes the draw delay after every
+// subscription. The first drops connections are closed after the
+// subscription instead, before the draw is pushed
+type subscribeServer struct {
+	delay         time.Duration
+	drops         int32
+	subscriptions int32
+}
+
+// serve Answers the messages of a connection until the client closes it
+func (s *subscribeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := protocol.NewDecoder(conn, protocol.TextCodec{})
+	encoder := protocol.NewEncoder(conn, protocol.TextCodec{})
+	for {
+		msg, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+		var reply *protocol.Response
+		switch msg.Type {
+		case protocol.MsgHello:
+			reply = &protocol.Response{
+				Kind:    protocol.ResponseWelcome,
+				Welcome: &protocol.Welcome{Version: 1, Features: []string{protocol.FeatureSubscribe}},
+			}
+		case protocol.MsgSubscribe:
+			if atomic.AddInt32(&s.subscriptions, 1) <= s.drops {
+				return
+			}
+			time.Sleep(s.delay)
+			reply = &protocol.Response{Kind: protocol.ResponseDrawResult, Draw: &protocol.DrawResult{Winners: []int{30904465}}}
+		default:
+			reply = &protocol.Response{Kind: protocol.ResponseError, Message: "Mensaje no reconocido"}
+		}
+		if err := encoder.Encode(&protocol.Message{Type: protocol.MsgResponse, Text: reply.String()}); err != nil {
+			return
+		}
+	}
+}
+
+// subscribedClient Returns a client connected to server that subscribes
+// to the results, reconnecting up to attempts times
+func subscribedClient(t *testing.T, server *subscribeServer, attempts int) *Client {
+	t.Helper()
+	c := newTestClient(t, ClientConfig{
+		Transport:   &PipeTransport{Serve: server.serve},
+		Handshake:   true,
+		Subscribe:   true,
+		ReadTimeout: 10 * time.Millisecond,
+		Reconnect: ReconnectConfig{
+			InitialDelay: time.Millisecond,
+			MaxAttempts:  attempts,
+		},
+	})
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !c.subscribed() {
+		t.Fatal("subscription was not negotiated")
+	}
+	t.Cleanup(func() { c.closeClientSocket() })
+	return c
+}
+
+func TestSubscribeResultsWaitsForADelayedPush(t *testing.T) {
+	// The push takes longer than the read timeout, which does not apply
+	// while subscribed
+	server := &subscribeServer{delay: 50 * time.Millisecond}
+	c := subscribedClient(t, server, 0)
+	if err := c.subscribeResults(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.draw == nil || len(c.draw.Winners) != 1 || c.draw.Winners[0] != 30904465 {
+		t.Fatalf("got draw %+v", c.draw)
+	}
+}
+
+func TestSubscribeResultsResubscribesWhenTheServerCloses(t *testing.T) {
+	server := &subscribeServer{drops: 1}
+	c := subscribedClient(t, server, 2)
+	if err := c.subscribeResults(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.draw == nil {
+		t.Fatal("draw was not received")
+	}
+	if subscriptions := atomic.LoadInt32(&server.subscriptions); subscriptions != 2 {
+		t.Fatalf("got %d subscriptions, want 2", subscriptions)
+	}
+
+	// Without reconnections the client fails
+	server = &subscribeServer{drops: 1}
+	c = subscribedClient(t, server, 0)
+	err := c.subscribeResults(context.Background())
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("got %v, want ConnectError", err)
+	}
+	if c.draw != nil {
+		t.Fatalf("got draw %+v", c.draw)
+	}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TLSConfig TLS configuration of the connection to the server. CAFile
+// is the bundle used to verify the server (the system pool is used if
+// empty), CertFile and KeyFile the client certificate presented for
+// mutual TLS, ServerName overrides the name verified in the server
+// certificate and MinVersion is the lowest TLS version accepted
+// ("1.2" if empty)
+type TLSConfig struct {
+	Enabled    bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	MinVersion string
+}
+
+// tlsVersions TLS versions that can be configured as minimum
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// build Returns the crypto/tls configuration, loading the CA bundle and
+// the client certificate. Returns nil if TLS is disabled
+func (t TLSConfig) build() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	minVersion := t.MinVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version: %s", minVersion)
+	}
+	config := &tls.Config{
+		MinVersion: version,
+		ServerName: t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("both the client certificate and key are needed for mutual TLS")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// logTLSState Logs the negotiated TLS version and the name in the
+// server certificate
+func logTLSState(logger logrus.FieldLogger, agencyID int, state tls.ConnectionState) {
+	server := ""
+	if len(state.PeerCertificates) > 0 {
+		server = state.PeerCertificates[0].Subject.CommonName
+	}
+	logger.Infof("action: tls_handshake | result: success | client_id: %v | version: %v | server: %v",
+		agencyID,
+		tlsVersionName(state.Version),
+		server,
+	)
+}
+
+// tlsVersionName Returns the configuration name of a TLS version
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate Writes to dir the certificate name.crt for commonName,
+// signed by parent (self-signed if nil), and its key name.key. Returns
+// the certificate and its key
+func writeCertificate(t *testing.T, dir string, name string, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestTLSConfigBuild(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", "lottery-ca", nil, nil)
+	writeCertificate(t, dir, "server", "server", ca, caKey)
+	writeCertificate(t, dir, "client", "agency-1", ca, caKey)
+
+	if config, err := (TLSConfig{CAFile: "missing.crt"}).build(); config != nil || err != nil {
+		t.Fatalf("got %v (%v) with TLS disabled", config, err)
+	}
+
+	config, err := TLSConfig{Enabled: true}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.RootCAs != nil || len(config.Certificates) != 0 {
+		t.Fatalf("got %+v by default", config)
+	}
+
+	config, err = TLSConfig{
+		Enabled:    true,
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "server",
+		MinVersion: "1.3",
+	}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS13 || config.ServerName != "server" || len(config.Certificates) != 1 {
+		t.Fatalf("got %+v", config)
+	}
+
+	// The client verifies the server with the CA and presents its
+	// certificate, which the server verifies with the same CA
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    config.RootCAs,
+	})
+	defer serverConn.Close()
+	handshaked := make(chan error, 1)
+	go func() { handshaked <- server.Handshake() }()
+	if err := tls.Client(clientConn, config).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handshaked; err != nil {
+		t.Fatal(err)
+	}
+	if peers := server.ConnectionState().PeerCertificates; len(peers) == 0 || peers[0].Subject.CommonName != "agency-1" {
+		t.Fatalf("server got client certificates %v", peers)
+	}
+}
+
+func TestTLSConfigBuildRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "client", "agency-1", nil, nil)
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]TLSConfig{
+		"unknown version":  {MinVersion: "2.0"},
+		"missing CA":       {CAFile: filepath.Join(dir, "missing.crt")},
+		"CA without certs": {CAFile: notPEM},
+		"cert without key": {CertFile: filepath.Join(dir, "client.crt")},
+		"key without cert": {KeyFile: filepath.Join(dir, "client.key")},
+		"missing cert":     {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "client.key")},
+		"mismatched pair":  {CertFile: filepath.Join(dir, "client.crt"), KeyFile: notPEM},
+	}
+	for name, settings := range cases {
+		settings.Enabled = true
+		if config, err := settings.build(); err == nil {
+			t.Fatalf("%s: got %+v, want an error", name, config)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Transport Opens the connections to the server
+type Transport interface {
+	// Dial Connects to the server, giving up when ctx is done
+	Dial(ctx context.Context) (net.Conn, error)
+	// String Returns the address of the server, used in logs
+	String() string
+}
+
+// netTransport Transport over a network of the net package, optionally
+// wrapped in TLS
+type netTransport struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+}
+
+// Dial Connects to the server. The TLS handshake is part of the dial
+func (t *netTransport) Dial(ctx context.Context) (net.Conn, error) {
+	if t.tlsConfig != nil {
+		dialer := &tls.Dialer{Config: t.tlsConfig}
+		return dialer.DialContext(ctx, t.network, t.address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, t.network, t.address)
+}
+
+// String Returns the URL of the server
+func (t *netTransport) String() string {
+	scheme := t.network
+	if t.tlsConfig != nil && t.network == "tcp" {
+		scheme = "tls"
+	}
+	if t.network == "unix" {
+		return fmt.Sprintf("unix://%s", t.address)
+	}
+	return fmt.Sprintf("%s://%s", scheme, t.address)
+}
+
+// PipeTransport In-memory transport, mostly meant for tests. Every Dial
+// creates a synchronous net.Pipe and runs Serve with its other end in a
+// new goroutine, which plays the role of the server
+type PipeTransport struct {
+	Serve func(conn net.Conn)
+}
+
+// Dial Returns the client end of a new pipe
+func (t *PipeTransport) Dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	go t.Serve(server)
+	return client, nil
+}
+
+// String Returns a fixed name, pipes have no address
+func (t *PipeTransport) String() string {
+	return "pipe://"
+}
+
+// newTransport Returns the transport of the config, or the one of its
+// server address if none was given. TLS is always enabled for tls://
+// addresses
+func newTransport(config ClientConfig) (Transport, error) {
+	if config.Transport != nil {
+		return config.Transport, nil
+	}
+	settings := config.TLS
+	if strings.HasPrefix(config.ServerAddress, "tls://") {
+		settings.Enabled = true
+	}
+	tlsConfig, err := settings.build()
+	if err != nil {
+		return nil, err
+	}
+	return ParseTransport(config.ServerAddress, tlsConfig)
+}
+
+// ParseTransport Returns the transport of a server address, which is
+// either a "host:port" pair (plain TCP, kept for compatibility) or an
+// URL:
+//
+//	tcp://host:port     TCP over IPv4 or IPv6
+//	tcp6://[::1]:port   TCP over IPv6 only
+//	unix:///path/sock   Unix socket
+//	tls://host:port     TCP with TLS
+//
+// If tlsConfig is not nil every connection is wrapped in TLS, which
+// tls:// requires
+func ParseTransport(address string, tlsConfig *tls.Config) (Transport, error) {
+	if !strings.Contains(address, "://") {
+		return &netTransport{network: "tcp", address: address, tlsConfig: tlsConfig}, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %v", address, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid unix socket address %q, expected unix:///path", address)
+		}
+		return &netTransport{network: "unix", address: u.Path, tlsConfig: tlsConfig}, nil
+	case "tcp", "tcp6", "tls":
+		if u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid server address %q, expected %s://host:port", address, u.Scheme)
+		}
+		if u.Scheme == "tls" {
+			if tlsConfig == nil {
+				return nil, fmt.Errorf("TLS configuration missing for %q", address)
+			}
+			return &netTransport{network: "tcp", address: u.Host, tlsConfig: tlsConfig}, nil
+		}
+		return &netTransport{network: u.Scheme, address: u.Host, tlsConfig: tlsConfig}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q in server address %q", u.Scheme, address)
+}
+
+// dialTransport Connects through the transport, giving up after timeout
+// (no limit if 0) or when ctx is done. Only failures of the dial are
+// wrapped in errConnectionFailed, the error of ctx is returned as is
+func dialTransport(ctx context.Context, transport Transport, timeout time.Duration) (net.Conn, error) {
+	dialCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := transport.Dial(dialCtx)
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errConnectionFailed, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTransport(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	cases := []struct {
+		address   string
+		tlsConfig *tls.Config
+		network   string
+		host      string
+		url       string
+	}{
+		{"server:12345", nil, "tcp", "server:12345", "tcp://server:12345"},
+		{"tcp://server:12345", nil, "tcp", "server:12345", "tcp://server:12345"},
+		{"tcp://server:12345/", nil, "tcp", "server:12345", "tcp://server:12345"},
+		{"tcp6://[::1]:12345", nil, "tcp6", "[::1]:12345", "tcp6://[::1]:12345"},
+		{"unix:///tmp/server.sock", nil, "unix", "/tmp/server.sock", "unix:///tmp/server.sock"},
+		{"tls://server:12345", tlsConfig, "tcp", "server:12345", "tls://server:12345"},
+		{"server:12345", tlsConfig, "tcp", "server:12345", "tls://server:12345"},
+	}
+	for _, c := range cases {
+		transport, err := ParseTransport(c.address, c.tlsConfig)
+		if err != nil {
+			t.Fatalf("%s: %v", c.address, err)
+		}
+		parsed, ok := transport.(*netTransport)
+		if !ok {
+			t.Fatalf("%s: got %T", c.address, transport)
+		}
+		if parsed.network != c.network || parsed.address != c.host || parsed.tlsConfig != c.tlsConfig {
+			t.Fatalf("%s: got %s %s (TLS %v)", c.address, parsed.network, parsed.address, parsed.tlsConfig != nil)
+		}
+		if transport.String() != c.url {
+			t.Fatalf("%s: got URL %s, want %s", c.address, transport.String(), c.url)
+		}
+	}
+}
+
+func TestParseTransportRejectsInvalidAddresses(t *testing.T) {
+	addresses := []string{
+		"udp://server:12345",
+		"tcp://",
+		"tcp:///server",
+		"tcp://server:12345/path",
+		"unix://server/tmp/server.sock",
+		"unix://",
+		"tls://server:12345",
+		"tcp://server:port%",
+	}
+	for _, address := range addresses {
+		if transport, err := ParseTransport(address, nil); err == nil {
+			t.Fatalf("%s: got %s, want an error", address, transport)
+		}
+	}
+}
@@ -1,145 +1,149 @@
 package common
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
-	"net"
-	"os"
-	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
 )
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// CreateClientSocket Initializes client socket through the transport,
+// giving up after ConnectTimeout (which includes the TLS handshake) or
+// when ctx is done, or opens a stream if the client belongs to a Mux.
+// In case of failure, error is returned
+func (c *Client) createClientSocket(ctx context.Context) error {
+	if c.mux != nil {
+		stream, err := c.mux.open(c.config.ID, c.codec)
+		if err != nil {
+			return err
+		}
+		c.link = stream
+		return nil
+	}
+
+	conn, err := dialTransport(ctx, c.transport, c.config.ConnectTimeout)
 	if err != nil {
-		log.Fatalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
-		c.StopClient()
+		return err
 	}
-	c.conn = conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		logTLSState(c.logger, c.config.ID, tlsConn.ConnectionState())
+	}
+	c.link = newConnLink(conn, c.codec)
 	return nil
 }
 
-// CloseClientSocket Closes the client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-// it forces the connection to be closed no matter what
+// CloseClientSocket Closes the client socket, unless it was already
+// closed to stop a goroutine reading from it. Failures are logged and
+// returned, the socket is released anyway
 func (c *Client) closeClientSocket() error {
-	if c.conn != nil {
-		err := c.conn.Close()
-		if err != nil {
-			log.Fatalf(
-				"action: close_connection | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			c.StopClient()
-		}
-		c.conn = nil
+	if c.link == nil {
+		return nil
+	}
+	err := c.link.close()
+	c.link = nil
+	if err != nil {
+		c.logger.Errorf("action: close_connection | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
 	}
 	return nil
 }
 
-// openFile Opens the file in read mode (it does not create the file if it does not exist)
+// openFile Opens the bets file of the agency from Input, or from
+// DirDataPath if Input is empty (it does not create the file if it does
+// not exist). See openBetsFile for the inputs accepted
+// In case of failure, an InputError is returned
 func (c *Client) openFile() error {
-	filePath := fmt.Sprintf("%s/%s%d.csv", c.config.DirDataPath, c.config.FileDataName, c.config.ID)
-	file, err := os.Open(filePath)
+	name := fmt.Sprintf("%s%d.csv", c.config.FileDataName, c.config.ID)
+	input := c.config.Input
+	if input == "" {
+		input = fmt.Sprintf("%s/%s", c.config.DirDataPath, name)
+	}
+	file, err := openBetsFile(input, name)
 	if err != nil {
-		log.Fatalf("action: open_file | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
 		return err
 	}
 	c.data_file = file
 	return nil
 }
 
-// closeFile Closes the file
+// closeFile Closes the file. Failures are logged and returned, the file
+// is released anyway
 func (c *Client) closeFile() error {
-	if c.data_file != nil {
-		err := c.data_file.Close()
-		if err != nil {
-			log.Fatalf(
-				"action: close_file | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			return err
-		}
-		c.data_file = nil
+	if c.data_file == nil {
+		return nil
+	}
+	err := c.data_file.Close()
+	c.data_file = nil
+	if err != nil {
+		c.logger.Errorf("action: close_file | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return err
 	}
 	return nil
 }
 
-// waitOrStop Waits for the loop period or stops the client if stop_chan is flagged
-// Returns true if the client should stop
-func (c *Client) waitOrStop() bool {
-	select {
-	case <-time.After(c.config.LoopPeriod):
+// waitOrStop Waits for the loop period or stops the client if ctx is done
+// In case the client should stop, a Canceled error is returned
+func (c *Client) waitOrStop(ctx context.Context) error {
+	return c.waitFor(ctx, c.config.LoopPeriod)
+}
 
-	case <-c.stop_chan:
-		log.Warnf("action: loop_finished | result: aborted | client_id: %v", c.config.ID)
-		return true
+// waitFor Waits the given time or stops the client if ctx is done
+// In case the client should stop, a Canceled error is returned
+func (c *Client) waitFor(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return c.stopped(ctx)
 	}
-	return false
 }
 
 // askResults Sends a message to the server to ask for the results
 // Returns true if the client should wait for the results and keep
 // asking for them
-func (c *Client) askResults() (bool, error) {
-	message := fmt.Sprintf(
-		"[CLIENT %v] Awaiting results",
-		c.config.ID,
-	)
-	err := c.sendMessage(message)
-
+func (c *Client) askResults(ctx context.Context) (bool, error) {
+	err := c.sendMessage(ctx, &protocol.Message{
+		Type:     protocol.MsgAwaitResults,
+		AgencyID: c.config.ID,
+	})
 	if err != nil {
 		return false, err
 	}
 
-	result, err := c.receiveMessage()
+	response, err := c.receiveResponse(ctx)
 	if err != nil {
 		return false, err
 	}
-
-	wait, shouldReturn, returnValue1 := c.manageServerResponse(result)
-	if shouldReturn {
-		log.Fatalf("action: consulta_ganadores | result: fail | %v",
-			result,
-		)
-		return false, returnValue1
-	}
-
-	return wait, nil
+	return c.manageServerResponse(response)
 }
 
-// manageServerResponse Manages the server response
+// manageServerResponse Manages the server response to a results query
 // Returns true if the client should wait for the results and keep
-// asking for them
-func (c *Client) manageServerResponse(result string) (bool, bool, error) {
-	wait := true
-	if strings.HasPrefix(result, "OK: Sorteo") {
-		c.getWinners(result)
-		wait = false
-	} else if strings.HasPrefix(result, "ERROR") {
-		c.StopClient()
-		err := errors.New(result)
-		return false, true, err
-	} else if strings.HasPrefix(result, "WAIT") {
-		wait = true
-		log.Infof("action: consulta_ganadores | result: wait | %v",
-			result,
+// asking for them. A ServerRejected error is returned if the server
+// rejected the query, and a ProtocolError if it replied something else
+func (c *Client) manageServerResponse(response *protocol.Response) (bool, error) {
+	switch response.Kind {
+	case protocol.ResponseDrawResult:
+		c.getWinners(response.Draw)
+		return false, nil
+	case protocol.ResponseWait:
+		c.logger.Infof("action: consulta_ganadores | result: wait | client_id: %v | msg: %v",
+			c.config.ID,
+			response.Message,
 		)
+		return true, nil
+	case protocol.ResponseError:
+		return false, rejected(response)
 	}
-	return wait, false, nil
-}
\ No newline at end of file
+	return false, protocolError("unexpected %v reply to a results query", response.Kind)
+}
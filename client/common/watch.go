@@ -0,0 +1,356 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchProgress Upload of the watched directory. Chunks are numbered
+// across all the files, so the server tells a chunk sent again from a
+// new one
+type watchProgress struct {
+	// Seq Number of chunks acknowledged
+	Seq int `json:"seq"`
+	// Files Upload of every file, by name
+	Files map[string]fileProgress `json:"files"`
+}
+
+// fingerprintSize Bytes of a watched file hashed at its start and before
+// the offset uploaded, see fileFingerprint
+const fingerprintSize = 4096
+
+// fileProgress Upload of a watched file. Inode, ModTime and Fingerprint
+// identify the file that was uploaded, so a new file with the same name
+// or a file rewritten in place is detected
+type fileProgress struct {
+	// Offset Position in the file after the last acknowledged chunk
+	Offset int64 `json:"offset"`
+	// Row Number of bets acknowledged
+	Row int `json:"row"`
+	// Inode Inode of the file, 0 if it is unknown
+	Inode uint64 `json:"inode"`
+	// ModTime Modification time of the file when it was last read
+	ModTime time.Time `json:"mod_time"`
+	// Fingerprint Hash of the bytes uploaded, "" if it is unknown
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// replacedFile Returns why the file is not the one whose upload is saved
+// in done, or "" if it is the same file. A file whose inode changed, that
+// shrank, that is older than the one uploaded or whose bytes uploaded
+// changed was replaced
+func replacedFile(done fileProgress, info os.FileInfo, file io.ReaderAt) (string, error) {
+	if inode := fileInode(info); done.Inode != 0 && inode != 0 && inode != done.Inode {
+		return "file replaced", nil
+	}
+	if info.Size() < done.Offset {
+		return "file shrank", nil
+	}
+	if info.ModTime().Before(done.ModTime) {
+		return "file older than the one uploaded", nil
+	}
+	if done.Fingerprint != "" {
+		fingerprint, err := fileFingerprint(file, done.Offset)
+		if err != nil {
+			return "", err
+		}
+		if fingerprint != done.Fingerprint {
+			return "file rewritten", nil
+		}
+	}
+	return "", nil
+}
+
+// fileFingerprint Returns a hash of the first and the last
+// fingerprintSize bytes of the file before offset, so a file truncated
+// and written again in place is told apart from one that only grew
+// without reading all of it
+func fileFingerprint(file io.ReaderAt, offset int64) (string, error) {
+	head := offset
+	if head > fingerprintSize {
+		head = fingerprintSize
+	}
+	tail := offset - fingerprintSize
+	if tail < head {
+		tail = head
+	}
+	hash := sha256.New()
+	for _, part := range [][2]int64{{0, head}, {tail, offset}} {
+		if _, err := io.Copy(hash, io.NewSectionReader(file, part[0], part[1]-part[0])); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// watchProgressPath Returns the path where the progress of the watched
+// directory is saved, or "" if checkpoints are disabled
+func (c *Client) watchProgressPath() string {
+	if c.config.CheckpointDir == "" {
+		return ""
+	}
+	return filepath.Join(c.config.CheckpointDir, fmt.Sprintf("%s%d.watch", c.config.FileDataName, c.config.ID))
+}
+
+// loadWatchProgress Returns the progress saved by a previous run
+// In case it can not be read, an InputError is returned
+func (c *Client) loadWatchProgress() (*watchProgress, error) {
+	progress := &watchProgress{Files: make(map[string]fileProgress)}
+	path := c.watchProgressPath()
+	if path == "" {
+		return progress, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, &InputError{Path: path, Err: err}
+	}
+	if err := json.Unmarshal(data, progress); err != nil {
+		return nil, &InputError{Path: path, Err: fmt.Errorf("invalid progress: %v", err)}
+	}
+	if progress.Files == nil {
+		progress.Files = make(map[string]fileProgress)
+	}
+	return progress, nil
+}
+
+// saveWatchProgress Saves the progress of the watched directory. A
+// failure is only logged, the upload goes on
+func (c *Client) saveWatchProgress(progress *watchProgress) {
+	path := c.watchProgressPath()
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(progress)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		c.logger.Warnf("action: save_checkpoint | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+	}
+}
+
+// watchedFile Returns true if the file of the directory holds bets of the
+// agency: agency-N.csv or agency-N-<anything>.csv
+func (c *Client) watchedFile(name string) bool {
+	prefix := fmt.Sprintf("%s%d", c.config.FileDataName, c.config.ID)
+	return name == prefix+".csv" ||
+		(strings.HasPrefix(name, prefix+"-") && strings.HasSuffix(name, ".csv"))
+}
+
+// watchDirectory Uploads the bets of the agency as they are written to
+// DirDataPath, until ctx is done. Files are uploaded when they are
+// created or written, and the whole directory is scanned again every
+// LoopPeriod in case a change was missed. Only complete lines are sent,
+// so a file may be written in several steps. The upload of every file is
+// saved next to the checkpoints, so no bet is sent twice even if the
+// client is restarted. The client does not wait for the draw
+// In case of failure, error is returned: an InputError if Input is set or
+// the directory can not be watched. Stopping the client is not a failure
+func (c *Client) watchDirectory(ctx context.Context) error {
+	if c.config.Input != "" {
+		return &InputError{Path: c.config.Input, Err: errors.New("the watched files are read from DirDataPath, not from an input")}
+	}
+	progress, err := c.loadWatchProgress()
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return &InputError{Path: c.config.DirDataPath, Err: err}
+	}
+	defer watcher.Close()
+	if err := watcher.Add(c.config.DirDataPath); err != nil {
+		return &InputError{Path: c.config.DirDataPath, Err: err}
+	}
+
+	defer c.closeClientSocket()
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+	c.logger.Infof("action: watch | result: in_progress | client_id: %v | dir: %v",
+		c.config.ID,
+		c.config.DirDataPath,
+	)
+
+	var rescan <-chan time.Time
+	if c.config.LoopPeriod > 0 {
+		ticker := time.NewTicker(c.config.LoopPeriod)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	err = c.uploadDirectory(ctx, progress)
+	if err == nil && c.on_uploaded != nil {
+		// The bets already written count as the upload of the agency
+		c.on_uploaded()
+	}
+	for err == nil {
+		select {
+		case event := <-watcher.Events:
+			name := filepath.Base(event.Name)
+			if c.watchedFile(name) && event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+				err = c.uploadFile(ctx, progress, name)
+			}
+		case watchErr := <-watcher.Errors:
+			c.logger.Warnf("action: watch | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				watchErr,
+			)
+		case <-rescan:
+			err = c.uploadDirectory(ctx, progress)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if ctx.Err() != nil {
+		c.logger.Infof("action: watch | result: success | client_id: %v | msg: stopped",
+			c.config.ID,
+		)
+		return nil
+	}
+	return err
+}
+
+// uploadDirectory Uploads the new bets of every file of the agency
+func (c *Client) uploadDirectory(ctx context.Context, progress *watchProgress) error {
+	entries, err := ioutil.ReadDir(c.config.DirDataPath)
+	if err != nil {
+		return &InputError{Path: c.config.DirDataPath, Err: err}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !c.watchedFile(entry.Name()) {
+			continue
+		}
+		if err := c.uploadFile(ctx, progress, entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile Uploads the complete lines written to the file since its
+// last upload, saving the progress after every acknowledged chunk. A
+// file that was replaced (see replacedFile) is uploaded again from the
+// start. As the draw is not awaited, acknowledged bets are not kept
+// In case of failure, error is returned
+func (c *Client) uploadFile(ctx context.Context, progress *watchProgress, name string) error {
+	path := filepath.Join(c.config.DirDataPath, name)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return &InputError{Path: path, Err: err}
+	}
+	c.data_file = &betsFile{Reader: file, path: path, name: name, closers: []io.Closer{file}}
+	defer c.closeFile()
+
+	info, err := file.Stat()
+	if err != nil {
+		return &InputError{Path: path, Err: err}
+	}
+	done := progress.Files[name]
+	reason, err := replacedFile(done, info, file)
+	if err != nil {
+		return &InputError{Path: path, Err: err}
+	}
+	if reason != "" {
+		c.logger.Warnf("action: watch | result: in_progress | client_id: %v | file: %v | msg: %v, uploading it again",
+			c.config.ID,
+			name,
+			reason,
+		)
+		done = fileProgress{}
+	}
+	done.Inode = fileInode(info)
+	done.ModTime = info.ModTime()
+	length, err := completeLength(file, done.Offset, info.Size())
+	if err != nil {
+		return &InputError{Path: path, Err: err}
+	}
+	if length == 0 {
+		return nil
+	}
+	if _, err := file.Seek(done.Offset, io.SeekStart); err != nil {
+		return &InputError{Path: path, Err: err}
+	}
+
+	c.data_reader = newOffsetReader(io.LimitReader(file, length), done.Offset)
+	c.pending = nil
+	reader := csv.NewReader(c.data_reader)
+	for {
+		bets, end, err := c.readBets(reader)
+		if err != nil {
+			return err
+		}
+		if len(bets) > 0 {
+			if err := c.throttle(ctx, len(bets)); err != nil {
+				return err
+			}
+			err := sendBets(ctx, c, progress.Seq+1, bets)
+			for _, bet := range bets {
+				delete(c.uploaded_bets, bet.GetPersonalID())
+			}
+			if err != nil {
+				return err
+			}
+			done.Offset = c.read_offset
+			done.Row += len(bets)
+			if done.Fingerprint, err = fileFingerprint(file, done.Offset); err != nil {
+				return &InputError{Path: path, Err: err}
+			}
+			progress.Seq++
+			progress.Files[name] = done
+			c.saveWatchProgress(progress)
+		}
+		if end || len(bets) == 0 {
+			break
+		}
+	}
+	c.logger.Infof("action: watch_upload | result: success | client_id: %v | file: %v | row: %v",
+		c.config.ID,
+		name,
+		done.Row,
+	)
+	return nil
+}
+
+// completeLength Returns the length of the complete lines of the file
+// from offset up to size, a last line without its newline is left out
+func completeLength(file *os.File, offset int64, size int64) (int64, error) {
+	buffer := make([]byte, 4096)
+	for end := size; end > offset; {
+		start := end - int64(len(buffer))
+		if start < offset {
+			start = offset
+		}
+		n, err := file.ReadAt(buffer[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buffer[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1 - offset, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,193 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteLength(t *testing.T) {
+	long := strings.Repeat("x", 5000) + "\n"
+	cases := []struct {
+		content string
+		offset  int64
+		want    int64
+	}{
+		{"a\nbb\ncc", 0, 5},
+		{"a\nbb\ncc", 2, 3},
+		{"a\nbb\n", 0, 5},
+		{"a\nbb\ncc", 5, 0},
+		{"abc", 0, 0},
+		{long + "y", 0, int64(len(long))},
+		{long + strings.Repeat("y", 5000), 0, int64(len(long))},
+	}
+	for i, c := range cases {
+		path := filepath.Join(t.TempDir(), "bets.csv")
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, err := completeLength(file, c.offset, int64(len(c.content)))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length != c.want {
+			t.Fatalf("case %d: got %d, want %d", i, length, c.want)
+		}
+	}
+}
+
+// appendBets Appends count bets, numbered from first, to the file
+func appendBets(t *testing.T, path string, first int, count int) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := first; i < first+count; i++ {
+		if _, err := fmt.Fprintf(file, "Name%d,Surname,%d,1990-01-01,%d\n", i, 10000000+i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	dir := t.TempDir()
+	server := newBetServer(nil)
+	c := newTestClient(t, uploadConfig(dir, server, 1))
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeClientSocket()
+	progress := &watchProgress{Files: make(map[string]fileProgress)}
+	path := filepath.Join(dir, "agency-1.csv")
+	upload := func() {
+		t.Helper()
+		if err := c.uploadFile(context.Background(), progress, "agency-1.csv"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendBets(t, path, 0, 3)
+	upload()
+	appendBets(t, path, 3, 2)
+	upload()
+	server.checkStoredOnce(t, 5)
+	if len(c.uploaded_bets) != 0 {
+		t.Fatalf("acknowledged bets were kept: %v", c.uploaded_bets)
+	}
+
+	// A new file with the same name is uploaded from the start
+	replacement := filepath.Join(dir, "new.csv")
+	appendBets(t, replacement, 100, 6)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	upload()
+	server.checkStoredOnce(t, 11)
+	if done := progress.Files["agency-1.csv"]; done.Row != 6 {
+		t.Fatalf("got progress %+v after the replacement", done)
+	}
+
+	// So is a file truncated and written again in place, even if it is
+	// not shorter than the part uploaded
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendBets(t, path, 200, 8)
+	upload()
+	server.checkStoredOnce(t, 19)
+	if done := progress.Files["agency-1.csv"]; done.Row != 8 {
+		t.Fatalf("got progress %+v after the rewrite", done)
+	}
+}
+
+func TestReplacedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	appendBets(t, path, 0, 2)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := fileProgress{Offset: info.Size(), Row: 2, Inode: fileInode(info), ModTime: info.ModTime()}
+	cases := map[string]fileProgress{
+		"":                                 same,
+		"file shrank":                      {Offset: info.Size() + 1, Inode: same.Inode, ModTime: same.ModTime},
+		"file older than the one uploaded": {Offset: 1, Inode: same.Inode, ModTime: info.ModTime().Add(time.Second)},
+	}
+	if same.Inode != 0 {
+		cases["file replaced"] = fileProgress{Offset: 1, Inode: same.Inode + 1, ModTime: same.ModTime}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fingerprint, err := fileFingerprint(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	same.Fingerprint = fingerprint
+	cases["file rewritten"] = fileProgress{Offset: info.Size(), Inode: same.Inode, ModTime: same.ModTime, Fingerprint: "other"}
+	for want, done := range cases {
+		if reason, err := replacedFile(done, info, file); err != nil || reason != want {
+			t.Fatalf("got %q (%v) for %+v, want %q", reason, err, done, want)
+		}
+	}
+	// Progress saved before inodes and fingerprints were recorded
+	if reason, err := replacedFile(fileProgress{Offset: 1}, info, file); err != nil || reason != "" {
+		t.Fatalf("got %q (%v) without inode", reason, err)
+	}
+}
+
+func TestFileFingerprint(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	fingerprintOf := func(content []byte, offset int64) string {
+		t.Helper()
+		fingerprint, err := fileFingerprint(bytes.NewReader(content), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint
+	}
+	// Bytes appended after the offset do not change it
+	if fingerprintOf(content, 9000) != fingerprintOf(content[:9000], 9000) {
+		t.Fatal("the fingerprint depends on the bytes after the offset")
+	}
+	// Changes at the start or right before the offset do
+	for _, changed := range []int{0, fingerprintSize - 1, 8999} {
+		rewritten := append([]byte(nil), content...)
+		rewritten[changed] = 'x'
+		if fingerprintOf(rewritten, 9000) == fingerprintOf(content, 9000) {
+			t.Fatalf("a change at byte %d was not detected", changed)
+		}
+	}
+	// Short files are hashed whole
+	if fingerprintOf(content, 100) == fingerprintOf(content, 99) {
+		t.Fatal("the fingerprint does not depend on the offset")
+	}
+}
+
+func TestWatchDirectoryRejectsAnInput(t *testing.T) {
+	config := uploadConfig(t.TempDir(), newBetServer(nil), 1)
+	config.WatchDirectory = true
+	config.Input = "-"
+	c := newTestClient(t, config)
+	err := c.StartClientLoop(context.Background())
+	var inputErr *InputError
+	if !errors.As(err, &inputErr) {
+		t.Fatalf("got %v, want an InputError", err)
+	}
+}
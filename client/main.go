@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -35,16 +37,52 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server", "connect_timeout")
+	v.BindEnv("server", "read_timeout")
+	v.BindEnv("server", "write_timeout")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "lapse")
+	v.BindEnv("agencies", "list")
+	v.BindEnv("agencies", "concurrency")
+	v.BindEnv("agencies", "multiplex")
+	v.BindEnv("rate_limit", "bets_per_second")
+	v.BindEnv("rate_limit", "batches_per_second")
+	v.BindEnv("heartbeat", "interval")
+	v.BindEnv("heartbeat", "timeout")
+	v.BindEnv("reconnect", "initial_delay")
+	v.BindEnv("reconnect", "multiplier")
+	v.BindEnv("reconnect", "max_delay")
+	v.BindEnv("reconnect", "max_attempts")
+	v.BindEnv("reconnect", "jitter")
+	v.BindEnv("watch", "enabled")
+	v.BindEnv("checkpoint", "enabled")
+	v.BindEnv("checkpoint", "dir")
 	v.BindEnv("log", "level")
 	v.BindEnv("bet", "name")
 	v.BindEnv("bet", "surname")
 	v.BindEnv("bet", "personal_id")
 	v.BindEnv("bet", "birth_date")
 	v.BindEnv("bet_chunk", "size")
+	v.BindEnv("bet_chunk", "max_bytes")
+	v.BindEnv("bet_chunk", "target_rtt")
 	v.BindEnv("bet_chunk", "dir_data_path")
 	v.BindEnv("bet_chunk", "file_name")
+	v.BindEnv("bet_chunk", "input")
+	v.BindEnv("bet_chunk", "max_retries")
+	v.BindEnv("bet_chunk", "window")
+	v.BindEnv("server.tls", "enabled")
+	v.BindEnv("server.tls", "ca")
+	v.BindEnv("server.tls", "cert")
+	v.BindEnv("server.tls", "key")
+	v.BindEnv("server.tls", "server_name")
+	v.BindEnv("server.tls", "min_version")
+	v.BindEnv("auth", "secret")
+	v.BindEnv("protocol", "format")
+	v.BindEnv("protocol", "handshake")
+	v.BindEnv("protocol", "compression")
+	v.BindEnv("protocol", "compression_threshold")
+	v.BindEnv("protocol", "subscribe")
+	v.BindEnv("protocol", "subscribe_timeout")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -64,6 +102,25 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	// Rate limits are optional, the upload is not throttled if they are 0
+	for _, key := range []string{"rate_limit.bets_per_second", "rate_limit.batches_per_second"} {
+		if v.GetFloat64(key) < 0 {
+			env := "CLI_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+			return nil, errors.Errorf("%s env var must not be negative.", env)
+		}
+	}
+
+	// Timeouts, heartbeats and reconnections are optional, they are disabled if not set
+	for _, key := range []string{"server.connect_timeout", "server.read_timeout", "server.write_timeout", "heartbeat.interval", "heartbeat.timeout", "protocol.subscribe_timeout", "reconnect.initial_delay", "reconnect.max_delay", "bet_chunk.target_rtt"} {
+		if !v.IsSet(key) {
+			continue
+		}
+		if _, err := time.ParseDuration(v.GetString(key)); err != nil {
+			env := "CLI_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+			return nil, errors.Wrapf(err, "Could not parse %s env var as time.Duration.", env)
+		}
+	}
+
 	return v, nil
 }
 
@@ -88,30 +145,124 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	logrus.Infof("action: config | result: success | client_id: %d | server_address: %s | loop_lapse: %v | loop_period: %v | log_level: %s | bet_name: %s | bet_surname: %s | bet_personal_id: %s | bet_birth_date: %s | bet_chunk_size: %d | bet_chunk_dir_data_path: %s | bet_chunk_file_name: %s",
+	logrus.Infof("action: config | result: success | client_id: %d | server_address: %s | server_connect_timeout: %v | server_read_timeout: %v | server_write_timeout: %v | server_tls_enabled: %v | server_tls_ca: %s | server_tls_cert: %s | server_tls_server_name: %s | server_tls_min_version: %s | loop_lapse: %v | loop_period: %v | rate_limit_bets_per_second: %v | rate_limit_batches_per_second: %v | heartbeat_interval: %v | heartbeat_timeout: %v | reconnect_initial_delay: %v | reconnect_multiplier: %v | reconnect_max_delay: %v | reconnect_max_attempts: %d | reconnect_jitter: %v | watch_enabled: %v | checkpoint_enabled: %v | checkpoint_dir: %s | agencies_list: %s | agencies_concurrency: %d | agencies_multiplex: %v | log_level: %s | bet_name: %s | bet_surname: %s | bet_personal_id: %s | bet_birth_date: %s | bet_chunk_size: %d | bet_chunk_max_bytes: %d | bet_chunk_target_rtt: %v | bet_chunk_dir_data_path: %s | bet_chunk_file_name: %s | bet_chunk_input: %s | bet_chunk_max_retries: %d | bet_chunk_window: %d | auth_enabled: %v | protocol_format: %s | protocol_handshake: %v | protocol_compression: %v | protocol_compression_threshold: %d | protocol_subscribe: %v | protocol_subscribe_timeout: %v",
 		v.GetInt("id"),
 		v.GetString("server.address"),
+		v.GetDuration("server.connect_timeout"),
+		v.GetDuration("server.read_timeout"),
+		v.GetDuration("server.write_timeout"),
+		v.GetBool("server.tls.enabled"),
+		v.GetString("server.tls.ca"),
+		v.GetString("server.tls.cert"),
+		v.GetString("server.tls.server_name"),
+		v.GetString("server.tls.min_version"),
 		v.GetDuration("loop.lapse"),
 		v.GetDuration("loop.period"),
+		v.GetFloat64("rate_limit.bets_per_second"),
+		v.GetFloat64("rate_limit.batches_per_second"),
+		v.GetDuration("heartbeat.interval"),
+		v.GetDuration("heartbeat.timeout"),
+		v.GetDuration("reconnect.initial_delay"),
+		v.GetFloat64("reconnect.multiplier"),
+		v.GetDuration("reconnect.max_delay"),
+		v.GetInt("reconnect.max_attempts"),
+		v.GetFloat64("reconnect.jitter"),
+		v.GetBool("watch.enabled"),
+		v.GetBool("checkpoint.enabled"),
+		v.GetString("checkpoint.dir"),
+		v.GetString("agencies.list"),
+		v.GetInt("agencies.concurrency"),
+		v.GetBool("agencies.multiplex"),
 		v.GetString("log.level"),
 		v.GetString("bet.name"),
 		v.GetString("bet.surname"),
 		v.GetString("bet.personal_id"),
 		v.GetString("bet.birth_date"),
 		v.GetInt("bet_chunk.size"),
+		v.GetInt("bet_chunk.max_bytes"),
+		v.GetDuration("bet_chunk.target_rtt"),
 		v.GetString("bet_chunk.dir_data_path"),
 		v.GetString("bet_chunk.file_name"),
+		v.GetString("bet_chunk.input"),
+		v.GetInt("bet_chunk.max_retries"),
+		v.GetInt("bet_chunk.window"),
+		v.GetString("auth.secret") != "",
+		v.GetString("protocol.format"),
+		v.GetBool("protocol.handshake"),
+		v.GetBool("protocol.compression"),
+		v.GetInt("protocol.compression_threshold"),
+		v.GetBool("protocol.subscribe"),
+		v.GetDuration("protocol.subscribe_timeout"),
 	)
 }
 
-// handleSigterm Receives a channel of os.Signal and a client. It waits for a signal
-// and then stops the client loop
-func handleSigterm(sigs <-chan os.Signal, client *common.Client) {
-	<-sigs
-	client.StopClient()
+// Exit codes of the client, so the orchestration can tell the failures
+// apart. Invalid configurations exit with exitFailure
+const (
+	exitSuccess  = 0
+	exitFailure  = 1
+	exitInput    = 2
+	exitConnect  = 3
+	exitProtocol = 4
+	exitRejected = 5
+	exitCanceled = 6
+	exitLapse    = 7
+	exitMixed    = 8
+)
+
+// exitCode Returns the exit code of the error returned by the client loop
+func exitCode(err error) int {
+	var inputErr *common.InputError
+	var connectErr *common.ConnectError
+	var protocolErr *common.ProtocolError
+	var rejectedErr *common.ServerRejected
+	var canceledErr *common.Canceled
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.As(err, &inputErr):
+		return exitInput
+	case errors.As(err, &connectErr):
+		return exitConnect
+	case errors.As(err, &protocolErr):
+		return exitProtocol
+	case errors.As(err, &rejectedErr):
+		return exitRejected
+	case errors.Is(err, common.ErrLapseExceeded):
+		return exitLapse
+	case errors.As(err, &canceledErr):
+		return exitCanceled
+	}
+	return exitFailure
+}
+
+// aggregateExitCode Logs the result of every agency and returns the exit
+// code of the process: exitSuccess if every agency finished, the exit
+// code of the failed agencies if they all failed for the same reason, or
+// exitMixed otherwise
+func aggregateExitCode(ids []int, results map[int]error) int {
+	code := exitSuccess
+	for _, id := range ids {
+		err := results[id]
+		agencyCode := exitCode(err)
+		if err != nil {
+			log.Errorf("action: agency_finished | result: fail | client_id: %v | exit_code: %v | error: %v", id, agencyCode, err)
+		} else {
+			log.Infof("action: agency_finished | result: success | client_id: %v", id)
+		}
+		if code == exitSuccess {
+			code = agencyCode
+		} else if agencyCode != exitSuccess && agencyCode != code {
+			code = exitMixed
+		}
+	}
+	return code
 }
 
 func main() {
+	restartFromScratch := flag.Bool("restart-from-scratch", false, "ignore the checkpoint and send the bets file from the beginning")
+	flag.Parse()
+
 	v, err := InitConfig()
 	if err != nil {
 		log.Fatalf("%s", err)
@@ -124,24 +275,97 @@ func main() {
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
+	// An empty directory disables the checkpoints
+	checkpointDir := ""
+	if v.GetBool("checkpoint.enabled") {
+		checkpointDir = v.GetString("checkpoint.dir")
+	}
+
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetInt("id"),
-		LoopLapse:     v.GetDuration("loop.lapse"),
-		LoopPeriod:    v.GetDuration("loop.period"),
-		BetChunkSize:  v.GetInt("bet_chunk.size"),
-		DirDataPath:   v.GetString("bet_chunk.dir_data_path"),
-		FileDataName:  v.GetString("bet_chunk.file_name"),
+		ServerAddress:        v.GetString("server.address"),
+		ID:                   v.GetInt("id"),
+		LoopLapse:            v.GetDuration("loop.lapse"),
+		LoopPeriod:           v.GetDuration("loop.period"),
+		BetsPerSecond:        v.GetFloat64("rate_limit.bets_per_second"),
+		BatchesPerSecond:     v.GetFloat64("rate_limit.batches_per_second"),
+		BetChunkSize:         v.GetInt("bet_chunk.size"),
+		BetMaxBytes:          v.GetInt("bet_chunk.max_bytes"),
+		BetTargetRTT:         v.GetDuration("bet_chunk.target_rtt"),
+		DirDataPath:          v.GetString("bet_chunk.dir_data_path"),
+		FileDataName:         v.GetString("bet_chunk.file_name"),
+		Input:                v.GetString("bet_chunk.input"),
+		WatchDirectory:       v.GetBool("watch.enabled"),
+		BetMaxRetries:        v.GetInt("bet_chunk.max_retries"),
+		BetWindow:            v.GetInt("bet_chunk.window"),
+		ProtocolFormat:       v.GetString("protocol.format"),
+		Handshake:            v.GetBool("protocol.handshake"),
+		Compression:          v.GetBool("protocol.compression"),
+		CompressionThreshold: v.GetInt("protocol.compression_threshold"),
+		AuthSecret:           v.GetString("auth.secret"),
+		ConnectTimeout:       v.GetDuration("server.connect_timeout"),
+		ReadTimeout:          v.GetDuration("server.read_timeout"),
+		WriteTimeout:         v.GetDuration("server.write_timeout"),
+		HeartbeatInterval:    v.GetDuration("heartbeat.interval"),
+		HeartbeatTimeout:     v.GetDuration("heartbeat.timeout"),
+		Subscribe:            v.GetBool("protocol.subscribe"),
+		SubscribeTimeout:     v.GetDuration("protocol.subscribe_timeout"),
+		CheckpointDir:        checkpointDir,
+		RestartFromScratch:   *restartFromScratch,
+		TLS: common.TLSConfig{
+			Enabled:    v.GetBool("server.tls.enabled"),
+			CAFile:     v.GetString("server.tls.ca"),
+			CertFile:   v.GetString("server.tls.cert"),
+			KeyFile:    v.GetString("server.tls.key"),
+			ServerName: v.GetString("server.tls.server_name"),
+			MinVersion: v.GetString("server.tls.min_version"),
+		},
+		Reconnect: common.ReconnectConfig{
+			InitialDelay: v.GetDuration("reconnect.initial_delay"),
+			Multiplier:   v.GetFloat64("reconnect.multiplier"),
+			MaxDelay:     v.GetDuration("reconnect.max_delay"),
+			MaxAttempts:  v.GetInt("reconnect.max_attempts"),
+			Jitter:       v.GetFloat64("reconnect.jitter"),
+		},
 	}
 
-	client := common.NewClient(clientConfig)
+	// Watch mode follows the files of the directory, not a stream
+	if clientConfig.WatchDirectory && clientConfig.Input != "" {
+		log.Fatalf("watch.enabled reads the files of bet_chunk.dir_data_path, bet_chunk.input must be empty, got %q", clientConfig.Input)
+	}
 
-	// Create a channel to receive OS signals.
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM)
+	// Several agencies are run by this process if a list is configured
+	if list := v.GetString("agencies.list"); list != "" {
+		// Every agency reads its own file, a single file can not be shared
+		if input := clientConfig.Input; input != "" && !common.IsArchive(input) {
+			log.Fatalf("bet_chunk.input must be a zip archive to run several agencies, got %q", input)
+		}
+		ids, err := common.ParseAgencies(list, clientConfig)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		// Agencies may have their own secrets, auth.secrets.<id> (CLI_AUTH_SECRETS_<id>)
+		clientConfig.AuthSecrets = make(map[int]string)
+		for _, id := range ids {
+			key := fmt.Sprintf("auth.secrets.%d", id)
+			if v.IsSet(key) {
+				clientConfig.AuthSecrets[id] = v.GetString(key)
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+		results := common.RunAgencies(ctx, clientConfig, ids, v.GetInt("agencies.concurrency"), v.GetBool("agencies.multiplex"))
+		stop()
+		os.Exit(aggregateExitCode(ids, results))
+	}
 
-	// Handle SIGTERM signal
-	go handleSigterm(sigs, client)
+	client, err := common.NewClient(clientConfig)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 
-	client.StartClientLoop()
+	// SIGTERM cancels the context, which stops the client loop in
+	// whatever phase it is
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	err = client.StartClientLoop(ctx)
+	stop()
+	os.Exit(exitCode(err))
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+func TestExitCode(t *testing.T) {
+	inputErr := &common.InputError{Path: "agency-1.csv", Err: os.ErrNotExist}
+	lapseErr := &common.Canceled{Err: fmt.Errorf("%w: 1m0s", common.ErrLapseExceeded)}
+	cases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"success", nil, exitSuccess},
+		{"unknown", errors.New("unknown"), exitFailure},
+		{"input", inputErr, exitInput},
+		{"connect", &common.ConnectError{Address: "tcp://server:12345", Err: errors.New("refused")}, exitConnect},
+		{"protocol", &common.ProtocolError{Err: errors.New("malformed reply")}, exitProtocol},
+		{"rejected", &common.ServerRejected{Code: "bad_bet", Message: "Apuesta inválida"}, exitRejected},
+		{"canceled", &common.Canceled{Err: context.Canceled}, exitCanceled},
+		{"lapse", lapseErr, exitLapse},
+		{"wrapped input", fmt.Errorf("agency 1: %w", inputErr), exitInput},
+		{"wrapped lapse", fmt.Errorf("agency 1: %w", lapseErr), exitLapse},
+	}
+	for _, c := range cases {
+		if code := exitCode(c.err); code != c.code {
+			t.Fatalf("%s: got exit code %d, want %d", c.name, code, c.code)
+		}
+	}
+}
+
+func TestAggregateExitCode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	inputErr := &common.InputError{Path: "agency-1.csv", Err: os.ErrNotExist}
+	connectErr := &common.ConnectError{Address: "tcp://server:12345", Err: errors.New("refused")}
+	cases := []struct {
+		name    string
+		results map[int]error
+		code    int
+	}{
+		{"all finished", map[int]error{1: nil, 2: nil, 3: nil}, exitSuccess},
+		{"one failed", map[int]error{1: nil, 2: connectErr, 3: nil}, exitConnect},
+		{"all failed alike", map[int]error{1: inputErr, 2: inputErr, 3: inputErr}, exitInput},
+		{"failed alike after a success", map[int]error{1: nil, 2: connectErr, 3: connectErr}, exitConnect},
+		{"failed differently", map[int]error{1: inputErr, 2: nil, 3: connectErr}, exitMixed},
+		{"canceled and lapsed", map[int]error{1: &common.Canceled{Err: context.Canceled}, 2: &common.Canceled{Err: common.ErrLapseExceeded}, 3: nil}, exitMixed},
+		{"missing result", map[int]error{1: nil, 3: nil}, exitSuccess},
+	}
+	for _, c := range cases {
+		if code := aggregateExitCode([]int{1, 2, 3}, c.results); code != c.code {
+			t.Fatalf("%s: got exit code %d, want %d", c.name, code, c.code)
+		}
+	}
+}
@@ -3,13 +3,13 @@ module github.com/7574-sistemas-distribuidos/docker-compose-init
 go 1.17
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.8.1
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.5 // indirect
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// nonceSize Timestamp in unix nanoseconds (8 bytes) + random bytes (8 bytes)
+	nonceSize = 16
+	// macSize Size of an HMAC-SHA256
+	macSize = sha256.Size
+)
+
+// FeatureAuth Optional feature to sign every message after the handshake
+// with the secret of its agency, see HMACCodec
+const FeatureAuth = "auth"
+
+// Codes of the errors returned by Verifier
+const (
+	AuthUnknownAgency = "unknown_agency"
+	AuthBadSignature  = "bad_signature"
+	AuthExpiredNonce  = "expired_nonce"
+	AuthReplayedNonce = "replayed_nonce"
+)
+
+// newNonce Returns a nonce made of the current time and random bytes.
+// The time lets the verifier forget nonces older than its window
+func newNonce(now time.Time) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(now.UnixNano()))
+	if _, err := rand.Read(nonce[8:]); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// sign Returns the HMAC-SHA256 of the agency ID, the nonce and the payload
+func sign(secret []byte, agencyID int, nonce []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	binary.Write(mac, binary.BigEndian, uint32(agencyID))
+	mac.Write(nonce)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// HMACCodec Wraps a codec signing every message with the secret of the
+// agency. The encoding of the message is sent in a MsgSigned message of
+// the base codec, together with a nonce and the HMAC-SHA256 of the agency
+// ID, the nonce and the encoding. Replies of the server are not signed,
+// so they are decoded as is
+type HMACCodec struct {
+	inner  Codec
+	base   Codec
+	secret []byte
+}
+
+// NewHMACCodec Wraps inner to sign its messages, base encodes the envelope
+func NewHMACCodec(inner Codec, base Codec, secret []byte) *HMACCodec {
+	return &HMACCodec{inner: inner, base: base, secret: secret}
+}
+
+// Encode Encodes the message with the wrapped codec and signs it
+func (h *HMACCodec) Encode(msg *Message) ([]byte, error) {
+	payload, err := h.inner.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return h.base.Encode(&Message{
+		Type:     MsgSigned,
+		AgencyID: msg.AgencyID,
+		Nonce:    nonce,
+		MAC:      sign(h.secret, msg.AgencyID, nonce, payload),
+		Payload:  payload,
+	})
+}
+
+// Decode Decodes a message with the wrapped codec
+func (h *HMACCodec) Decode(reader *bufio.Reader) (*Message, error) {
+	return h.inner.Decode(reader)
+}
+
+// AuthError Message rejected by Verifier
+type AuthError struct {
+	Code     string
+	AgencyID int
+}
+
+// Error Returns the description of the error
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("message of agency %d not authenticated: %s", e.AgencyID, e.Code)
+}
+
+// Reply Returns the reply a server sends for the error
+func (e *AuthError) Reply() string {
+	return fmt.Sprintf("ERROR: Mensaje no autenticado | Code:%s", e.Code)
+}
+
+// Verifier Checks the signed messages of the agencies. A message is
+// accepted if it is signed with the secret of its agency and its nonce
+// was not seen before and is not older than maxAge. Nonces are only
+// remembered for maxAge, older ones are rejected by their timestamp.
+// It is safe for concurrent use
+type Verifier struct {
+	secrets   map[int][]byte
+	maxAge    time.Duration
+	now       func() time.Time
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+// NewVerifier Initializes a verifier with the secret of every agency
+func NewVerifier(secrets map[int][]byte, maxAge time.Duration) *Verifier {
+	return &Verifier{
+		secrets:   secrets,
+		maxAge:    maxAge,
+		now:       time.Now,
+		seen:      make(map[string]time.Time),
+		lastPurge: time.Now(),
+	}
+}
+
+// Verify Checks the signature and the nonce of a MsgSigned message. An
+// *AuthError is returned if the message is rejected
+func (v *Verifier) Verify(msg *Message) error {
+	if msg.Type != MsgSigned {
+		return &AuthError{Code: AuthBadSignature, AgencyID: msg.AgencyID}
+	}
+	secret, ok := v.secrets[msg.AgencyID]
+	if !ok {
+		return &AuthError{Code: AuthUnknownAgency, AgencyID: msg.AgencyID}
+	}
+	if len(msg.Nonce) != nonceSize || !hmac.Equal(msg.MAC, sign(secret, msg.AgencyID, msg.Nonce, msg.Payload)) {
+		return &AuthError{Code: AuthBadSignature, AgencyID: msg.AgencyID}
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := v.now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Nonce)))
+	if now.Sub(sent) > v.maxAge || sent.Sub(now) > v.maxAge {
+		return &AuthError{Code: AuthExpiredNonce, AgencyID: msg.AgencyID}
+	}
+	key := fmt.Sprintf("%d|%x", msg.AgencyID, msg.Nonce)
+	if _, replayed := v.seen[key]; replayed {
+		return &AuthError{Code: AuthReplayedNonce, AgencyID: msg.AgencyID}
+	}
+	v.seen[key] = sent
+
+	if now.Sub(v.lastPurge) > v.maxAge {
+		for k, at := range v.seen {
+			if now.Sub(at) > v.maxAge {
+				delete(v.seen, k)
+			}
+		}
+		v.lastPurge = now
+	}
+	return nil
+}
+
+// Open Verifies a MsgSigned message and decodes the message it carries
+// with the given codec
+func (v *Verifier) Open(codec Codec, msg *Message) (*Message, error) {
+	if err := v.Verify(msg); err != nil {
+		return nil, err
+	}
+	inner, err := codec.Decode(bufio.NewReader(bytes.NewReader(msg.Payload)))
+	if err != nil {
+		return nil, err
+	}
+	if inner.AgencyID != msg.AgencyID {
+		return nil, &AuthError{Code: AuthBadSignature, AgencyID: msg.AgencyID}
+	}
+	return inner, nil
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// BinaryCodec Codec of the length-prefixed binary protocol. Every
+// message starts with a fixed header (big endian):
+//
+//	| type (1 byte) | payload length (4 bytes) | agency ID (4 bytes) |
+//
+// The payload of MsgBets is the chunk Seq (4 bytes) and a bet count (2
+// bytes) followed by every bet as ID (4 bytes), PersonalID (4 bytes) and
+// Name, Surname and BirthDate, each one prefixed by its length (2 bytes).
+// MsgAwaitResults, MsgPing and MsgSubscribe have no payload, the payload
+// of MsgResponse is the UTF-8 text of the reply (its agency ID is only set
+// in multiplexed connections), the payload of MsgCompressed is the
+// gzipped frame of another message and the payload of MsgSigned is the
+// nonce (16 bytes), the HMAC (32 bytes) and the signed frame
+type BinaryCodec struct{}
+
+// Encode Returns the frame of the message
+func (BinaryCodec) Encode(msg *Message) ([]byte, error) {
+	var payload bytes.Buffer
+	switch msg.Type {
+	case MsgBets:
+		if len(msg.Bets) > MaxBetsPerMessage {
+			return nil, fmt.Errorf("too many bets in a message: %d", len(msg.Bets))
+		}
+		binary.Write(&payload, binary.BigEndian, uint32(msg.Seq))
+		binary.Write(&payload, binary.BigEndian, uint16(len(msg.Bets)))
+		for _, bet := range msg.Bets {
+			binary.Write(&payload, binary.BigEndian, uint32(bet.ID))
+			binary.Write(&payload, binary.BigEndian, uint32(bet.PersonalID))
+			for _, field := range []string{bet.Name, bet.Surname, bet.BirthDate} {
+				if len(field) > 0xFFFF {
+					return nil, fmt.Errorf("bet field too long: %d bytes", len(field))
+				}
+				binary.Write(&payload, binary.BigEndian, uint16(len(field)))
+				payload.WriteString(field)
+			}
+		}
+	case MsgAwaitResults, MsgPing, MsgSubscribe:
+	case MsgResponse:
+		payload.WriteString(msg.Text)
+	case MsgCompressed:
+		payload.Write(msg.Payload)
+	case MsgSigned:
+		if len(msg.Nonce) != nonceSize || len(msg.MAC) != macSize {
+			return nil, fmt.Errorf("malformed signature")
+		}
+		payload.Write(msg.Nonce)
+		payload.Write(msg.MAC)
+		payload.Write(msg.Payload)
+	default:
+		return nil, fmt.Errorf("unknown message type: %d", msg.Type)
+	}
+	if payload.Len() > maxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d bytes", payload.Len())
+	}
+
+	frame := make([]byte, binaryHeaderSize, binaryHeaderSize+payload.Len())
+	frame[0] = byte(msg.Type)
+	binary.BigEndian.PutUint32(frame[1:5], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[5:9], uint32(msg.AgencyID))
+	return append(frame, payload.Bytes()...), nil
+}
+
+// Decode Reads a whole frame and parses it
+func (BinaryCodec) Decode(reader *bufio.Reader) (*Message, error) {
+	header := make([]byte, binaryHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		Type:     MessageType(header[0]),
+		AgencyID: int(binary.BigEndian.Uint32(header[5:9])),
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > maxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	switch msg.Type {
+	case MsgBets:
+		seq, bets, err := decodeBinaryBets(msg.AgencyID, payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Seq = seq
+		msg.Bets = bets
+	case MsgAwaitResults, MsgPing, MsgSubscribe:
+	case MsgResponse:
+		msg.Text = string(payload)
+	case MsgCompressed:
+		msg.Payload = payload
+	case MsgSigned:
+		if len(payload) < nonceSize+macSize {
+			return nil, fmt.Errorf("truncated signed payload")
+		}
+		msg.Nonce = payload[:nonceSize]
+		msg.MAC = payload[nonceSize : nonceSize+macSize]
+		msg.Payload = payload[nonceSize+macSize:]
+	default:
+		return nil, fmt.Errorf("unknown message type: %d", msg.Type)
+	}
+	return msg, nil
+}
+
+// decodeBinaryBets Parses the payload of a MsgBets frame, returns
+// the chunk Seq and its bets
+func decodeBinaryBets(agencyID int, payload []byte) (int, []*Bet, error) {
+	errShort := fmt.Errorf("truncated bets payload")
+	if len(payload) < 6 {
+		return 0, nil, errShort
+	}
+	seq := int(binary.BigEndian.Uint32(payload))
+	count := int(binary.BigEndian.Uint16(payload[4:]))
+	payload = payload[6:]
+
+	bets := make([]*Bet, 0, count)
+	for i := 0; i < count; i++ {
+		if len(payload) < 8 {
+			return 0, nil, errShort
+		}
+		bet := &Bet{
+			AgencyID:   agencyID,
+			ID:         int(binary.BigEndian.Uint32(payload)),
+			PersonalID: int(binary.BigEndian.Uint32(payload[4:])),
+		}
+		payload = payload[8:]
+		for _, field := range []*string{&bet.Name, &bet.Surname, &bet.BirthDate} {
+			if len(payload) < 2 {
+				return 0, nil, errShort
+			}
+			size := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if len(payload) < size {
+				return 0, nil, errShort
+			}
+			*field = string(payload[:size])
+			payload = payload[size:]
+		}
+		bets = append(bets, bet)
+	}
+	if len(payload) != 0 {
+		return 0, nil, fmt.Errorf("unexpected %d trailing bytes in bets payload", len(payload))
+	}
+	return seq, bets, nil
+}
@@ -0,0 +1,133 @@
+// Package protocol Wire format spoken between the agencies and the
+// lottery server: the messages, the text and binary codecs and the
+// wrappers that compress and sign them
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const (
+	// binaryHeaderSize type (1 byte) + payload length (4 bytes) + agency ID (4 bytes)
+	binaryHeaderSize = 9
+	// maxPayloadSize Upper bound of a binary payload, avoids allocating
+	// huge buffers when a corrupted header is read
+	maxPayloadSize = 1 << 20
+)
+
+// Codec Encodes and decodes protocol messages on the wire
+type Codec interface {
+	Encode(msg *Message) ([]byte, error)
+	Decode(reader *bufio.Reader) (*Message, error)
+}
+
+// NewCodec Returns the codec for the given wire format
+func NewCodec(format string) (Codec, error) {
+	switch format {
+	case FormatText, "":
+		return TextCodec{}, nil
+	case FormatBinary:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown protocol format: %s", format)
+}
+
+// Encoder Writes protocol messages to a stream
+type Encoder struct {
+	writer io.Writer
+	codec  Codec
+}
+
+// NewEncoder Initializes an encoder writing to w with the given codec
+func NewEncoder(w io.Writer, codec Codec) *Encoder {
+	return &Encoder{writer: w, codec: codec}
+}
+
+// SetCodec Changes the codec used for the next messages, e.g. after the
+// handshake
+func (e *Encoder) SetCodec(codec Codec) {
+	e.codec = codec
+}
+
+// Encode Encodes the message and writes it whole
+// This method avoids short-write
+func (e *Encoder) Encode(msg *Message) error {
+	data, err := e.codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	for written := 0; written < len(data); {
+		n, err := e.writer.Write(data[written:])
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+// FormatError A message was read from the stream but does not follow the
+// format of the codec. The stream itself did not fail
+type FormatError struct {
+	Err error
+}
+
+// Error Returns the description of the error
+func (e *FormatError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap Returns the cause of the error
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// failureReader Remembers the error returned by the wrapped reader. The
+// error is kept once set, as the bufio.Reader may report it after data
+// read before it
+type failureReader struct {
+	reader io.Reader
+	err    error
+}
+
+// Read Reads from the wrapped reader and keeps its error
+func (r *failureReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Decoder Reads protocol messages from a stream
+type Decoder struct {
+	reader *bufio.Reader
+	source *failureReader
+	codec  Codec
+}
+
+// NewDecoder Initializes a decoder reading from r with the given codec
+func NewDecoder(r io.Reader, codec Codec) *Decoder {
+	source := &failureReader{reader: r}
+	return &Decoder{reader: bufio.NewReader(source), source: source, codec: codec}
+}
+
+// SetCodec Changes the codec used for the next messages. Data already
+// buffered is kept
+func (d *Decoder) SetCodec(codec Codec) {
+	d.codec = codec
+}
+
+// Decode Reads and decodes the next message
+// In case of failure, error is returned: the error of the stream if it
+// failed, a FormatError if the data read is not a valid message
+// This method avoids short-read
+func (d *Decoder) Decode() (*Message, error) {
+	msg, err := d.codec.Decode(d.reader)
+	if err != nil && d.source.err == nil {
+		return nil, &FormatError{Err: err}
+	}
+	return msg, err
+}
@@ -0,0 +1,427 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sampleBet(id int, name string, surname string) *Bet {
+	return &Bet{AgencyID: 1, ID: id, Name: name, Surname: surname, PersonalID: 30904465, BirthDate: "1999-03-17"}
+}
+
+// textGolden Messages and their exact encoding in the text format
+var textGolden = []struct {
+	name string
+	msg  *Message
+	wire string
+}{
+	{
+		name: "bets",
+		msg:  &Message{Type: MsgBets, AgencyID: 1, Bets: []*Bet{sampleBet(7574, "Santiago Lionel", "Lorca")}},
+		wire: "[CLIENT 1] Bets -> [AgencyID:1,ID:7574,Name:Santiago Lionel,Surname:Lorca,PersonalID:30904465,BirthDate:1999-03-17]\n",
+	},
+	{
+		name: "numbered bets",
+		msg:  &Message{Type: MsgBets, AgencyID: 1, Seq: 3, Bets: []*Bet{sampleBet(1, "Ana", "Paz"), sampleBet(2, "Juan", "Gil")}},
+		wire: "[CLIENT 1] Bets Seq:3 -> [AgencyID:1,ID:1,Name:Ana,Surname:Paz,PersonalID:30904465,BirthDate:1999-03-17]" +
+			"[AgencyID:1,ID:2,Name:Juan,Surname:Gil,PersonalID:30904465,BirthDate:1999-03-17]\n",
+	},
+	{
+		name: "escaped bet",
+		msg:  &Message{Type: MsgBets, AgencyID: 1, Bets: []*Bet{sampleBet(9, "Juan, Jr. [II]", "100%:Gil")}},
+		wire: "[CLIENT 1] Bets -> [AgencyID:1,ID:9,Name:Juan%2C Jr. %5BII%5D,Surname:100%25%3AGil,PersonalID:30904465,BirthDate:1999-03-17]\n",
+	},
+	{
+		name: "awaiting results",
+		msg:  &Message{Type: MsgAwaitResults, AgencyID: 4},
+		wire: "[CLIENT 4] Awaiting results\n",
+	},
+	{
+		name: "ping",
+		msg:  &Message{Type: MsgPing, AgencyID: 4},
+		wire: "[CLIENT 4] Ping\n",
+	},
+	{
+		name: "subscribe",
+		msg:  &Message{Type: MsgSubscribe, AgencyID: 4},
+		wire: "[CLIENT 4] Subscribe results\n",
+	},
+	{
+		name: "hello",
+		msg:  &Message{Type: MsgHello, AgencyID: 2, Versions: []int{1}, Features: []string{"binary", "gzip"}},
+		wire: "[CLIENT 2] Hello -> Versions:1 | Features:binary,gzip\n",
+	},
+	{
+		name: "compressed",
+		msg:  &Message{Type: MsgCompressed, AgencyID: 1, Payload: []byte{1, 2, 3}},
+		wire: "[CLIENT 1] Gzip -> AQID\n",
+	},
+	{
+		name: "response",
+		msg:  &Message{Type: MsgResponse, Text: "OK: Apuestas recibidas | Cantidad:5"},
+		wire: "OK: Apuestas recibidas | Cantidad:5\n",
+	},
+	{
+		name: "tagged response",
+		msg:  &Message{Type: MsgResponse, AgencyID: 3, Text: "WAIT: Esperando a las otras agencias"},
+		wire: "[AGENCY 3] WAIT: Esperando a las otras agencias\n",
+	},
+}
+
+func TestTextCodecGolden(t *testing.T) {
+	for _, tc := range textGolden {
+		t.Run(tc.name, func(t *testing.T) {
+			wire, err := TextCodec{}.Encode(tc.msg)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if string(wire) != tc.wire {
+				t.Fatalf("encode:\n got %q\nwant %q", wire, tc.wire)
+			}
+			msg, err := TextCodec{}.Decode(bufio.NewReader(bytes.NewReader(wire)))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(msg, tc.msg) {
+				t.Fatalf("decode:\n got %+v\nwant %+v", msg, tc.msg)
+			}
+		})
+	}
+}
+
+func TestHMACCodecGolden(t *testing.T) {
+	nonce := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	payload := []byte("[CLIENT 1] Awaiting results\n")
+	mac := sign([]byte("secret"), 1, nonce, payload)
+	want := "4913270f87eefa689b4fde36c52e89767d0878d0127bbf9bc08828e09309b7f7"
+	if hex.EncodeToString(mac) != want {
+		t.Fatalf("sign: got %x, want %s", mac, want)
+	}
+
+	wire, err := TextCodec{}.Encode(&Message{Type: MsgSigned, AgencyID: 1, Nonce: nonce, MAC: mac, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "[CLIENT 1] Signed Nonce:000102030405060708090a0b0c0d0e0f | HMAC:" + want + " -> [CLIENT 1] Awaiting results\n"
+	if string(wire) != line {
+		t.Fatalf("got %q\nwant %q", wire, line)
+	}
+}
+
+// signedMessage Returns the MsgSigned message the agency sends for msg,
+// as read by a server
+func signedMessage(t *testing.T, codec Codec, secret string, msg *Message) *Message {
+	t.Helper()
+	wire, err := NewHMACCodec(codec, codec, []byte(secret)).Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := codec.Decode(bufio.NewReader(bytes.NewReader(wire)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifierOpen(t *testing.T) {
+	secrets := map[int][]byte{1: []byte("secret"), 2: []byte("other")}
+	msg := &Message{Type: MsgBets, AgencyID: 1, Seq: 1, Bets: []*Bet{sampleBet(7, "Ana", "Paz")}}
+	for _, codec := range []Codec{TextCodec{}, BinaryCodec{}} {
+		verifier := NewVerifier(secrets, time.Minute)
+		signed := signedMessage(t, codec, "secret", msg)
+		opened, err := verifier.Open(codec, signed)
+		if err != nil {
+			t.Fatalf("%T: open: %v", codec, err)
+		}
+		if !reflect.DeepEqual(opened, msg) {
+			t.Fatalf("%T: got %+v, want %+v", codec, opened, msg)
+		}
+		if _, err := verifier.Open(codec, signed); authCode(err) != AuthReplayedNonce {
+			t.Fatalf("%T: replay: got %v", codec, err)
+		}
+	}
+}
+
+func TestVerifierRejections(t *testing.T) {
+	secrets := map[int][]byte{1: []byte("secret"), 2: []byte("other")}
+	msg := &Message{Type: MsgAwaitResults, AgencyID: 1}
+
+	tampered := signedMessage(t, TextCodec{}, "secret", msg)
+	tampered.MAC[0] ^= 0xFF
+	wrongSecret := signedMessage(t, TextCodec{}, "other", msg)
+	unknown := signedMessage(t, TextCodec{}, "secret", &Message{Type: MsgAwaitResults, AgencyID: 3})
+	unsigned := &Message{Type: MsgAwaitResults, AgencyID: 1}
+	cases := map[string]struct {
+		msg  *Message
+		code string
+	}{
+		"tampered mac":   {tampered, AuthBadSignature},
+		"wrong secret":   {wrongSecret, AuthBadSignature},
+		"unknown agency": {unknown, AuthUnknownAgency},
+		"unsigned":       {unsigned, AuthBadSignature},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := NewVerifier(secrets, time.Minute).Verify(tc.msg)
+			if authCode(err) != tc.code {
+				t.Fatalf("got %v, want %s", err, tc.code)
+			}
+		})
+	}
+}
+
+func TestVerifierRejectsExpiredNonce(t *testing.T) {
+	verifier := NewVerifier(map[int][]byte{1: []byte("secret")}, time.Minute)
+	signed := signedMessage(t, TextCodec{}, "secret", &Message{Type: MsgPing, AgencyID: 1})
+
+	verifier.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := verifier.Verify(signed); authCode(err) != AuthExpiredNonce {
+		t.Fatalf("late: got %v", err)
+	}
+	verifier.now = func() time.Time { return time.Now().Add(-2 * time.Minute) }
+	if err := verifier.Verify(signed); authCode(err) != AuthExpiredNonce {
+		t.Fatalf("early: got %v", err)
+	}
+}
+
+func TestVerifierOpenRejectsOtherAgency(t *testing.T) {
+	// Agency 1 signs a message that claims to be sent by agency 2
+	verifier := NewVerifier(map[int][]byte{1: []byte("secret"), 2: []byte("other")}, time.Minute)
+	payload, err := TextCodec{}.Encode(&Message{Type: MsgAwaitResults, AgencyID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := newNonce(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &Message{Type: MsgSigned, AgencyID: 1, Nonce: nonce, MAC: sign([]byte("secret"), 1, nonce, payload), Payload: payload}
+	if _, err := verifier.Open(TextCodec{}, signed); authCode(err) != AuthBadSignature {
+		t.Fatalf("got %v, want %s", err, AuthBadSignature)
+	}
+}
+
+// authCode Returns the code of an *AuthError, "" for any other error
+func authCode(err error) string {
+	if authErr, ok := err.(*AuthError); ok {
+		return authErr.Code
+	}
+	return ""
+}
+
+func TestBinaryCodecGolden(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  *Message
+		wire string
+	}{
+		{
+			name: "bets",
+			msg:  &Message{Type: MsgBets, AgencyID: 1, Seq: 1, Bets: []*Bet{sampleBet(7, "Ana", "Paz")}},
+			wire: "0100000024000000010000000100010000000701d790910003416e61000350617a000a313939392d30332d3137",
+		},
+		{
+			name: "awaiting results",
+			msg:  &Message{Type: MsgAwaitResults, AgencyID: 1},
+			wire: "020000000000000001",
+		},
+		{
+			name: "ping",
+			msg:  &Message{Type: MsgPing, AgencyID: 1},
+			wire: "070000000000000001",
+		},
+		{
+			name: "subscribe",
+			msg:  &Message{Type: MsgSubscribe, AgencyID: 1},
+			wire: "080000000000000001",
+		},
+		{
+			name: "response",
+			msg:  &Message{Type: MsgResponse, Text: "WAIT: x"},
+			wire: "030000000700000000574149543a2078",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			wire, err := BinaryCodec{}.Encode(tc.msg)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if hex.EncodeToString(wire) != tc.wire {
+				t.Fatalf("encode:\n got %x\nwant %s", wire, tc.wire)
+			}
+			msg, err := BinaryCodec{}.Decode(bufio.NewReader(bytes.NewReader(wire)))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(msg, tc.msg) {
+				t.Fatalf("decode:\n got %+v\nwant %+v", msg, tc.msg)
+			}
+		})
+	}
+}
+
+func TestGzipCodecRoundTrip(t *testing.T) {
+	bets := make([]*Bet, 50)
+	for i := range bets {
+		bets[i] = sampleBet(i+1, "Santiago Lionel", "Lorca")
+	}
+	small := &Message{Type: MsgBets, AgencyID: 1, Seq: 2, Bets: []*Bet{sampleBet(1, "Ana", "Paz")}}
+	large := &Message{Type: MsgBets, AgencyID: 1, Seq: 3, Bets: bets}
+	for _, inner := range []Codec{TextCodec{}, BinaryCodec{}} {
+		compressed := 0
+		codec := NewGzipCodec(inner, 1, func(agencyID int, originalSize int, compressedSize int) {
+			if compressedSize >= originalSize {
+				t.Errorf("compressed %d bytes to %d", originalSize, compressedSize)
+			}
+			compressed++
+		})
+		for _, msg := range []*Message{small, large} {
+			plain, err := inner.Encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wire, err := codec.Encode(msg)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			// A frame that does not shrink is sent as is
+			if msg == small && !bytes.Equal(wire, plain) {
+				t.Fatalf("%T: small message was compressed: %q", inner, wire)
+			}
+			if msg == large && len(wire) >= len(plain) {
+				t.Fatalf("%T: large message was not compressed", inner)
+			}
+			decoded, err := codec.Decode(bufio.NewReader(bytes.NewReader(wire)))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Fatalf("%T: got %+v, want %+v", inner, decoded, msg)
+			}
+		}
+		if compressed != 1 {
+			t.Fatalf("%T: hook called %d times, want 1", inner, compressed)
+		}
+	}
+}
+
+// shortWriter Writer that accepts a single byte per call
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p[:1])
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var stream shortWriter
+	encoder := NewEncoder(&stream, TextCodec{})
+	messages := []*Message{textGolden[0].msg, textGolden[3].msg}
+	for _, msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decoder := NewDecoder(&stream.Buffer, TextCodec{})
+	for _, want := range messages {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, want) {
+			t.Fatalf("got %+v, want %+v", msg, want)
+		}
+	}
+}
+
+func TestDecoderFormatErrors(t *testing.T) {
+	malformed := map[string]struct {
+		codec Codec
+		data  []byte
+	}{
+		"text agency": {TextCodec{}, []byte("[CLIENT x] Ping\n")},
+		"binary size": {BinaryCodec{}, mustHex(t, "03ffffffff00000001")},
+	}
+	for name, c := range malformed {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(c.data), c.codec).Decode()
+			var formatErr *FormatError
+			if !errors.As(err, &formatErr) {
+				t.Fatalf("got %v, want a FormatError", err)
+			}
+		})
+	}
+
+	// A stream that ends within a message failed, the message is not malformed
+	truncated := mustHex(t, "030000000a00000001616263")
+	_, err := NewDecoder(bytes.NewReader(truncated), BinaryCodec{}).Decode()
+	var formatErr *FormatError
+	if err == nil || errors.As(err, &formatErr) {
+		t.Fatalf("got %v, want the error of the stream", err)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	replies := []string{
+		"OK: Apuestas recibidas | Cantidad:5",
+		"OK: Apuestas recibidas | Cantidad:5 | Seq:3",
+		"OK: Sorteo realizado | Ganadores:30904465,20025664",
+		"OK: Sorteo realizado | Ganadores:",
+		"WAIT: Esperando a las otras agencias",
+		"ERROR: Mensaje no reconocido | Code:unknown_message",
+		"ERROR: Mensaje no reconocido",
+		"WELCOME: Version:1 | Features:gzip",
+		"PONG",
+	}
+	for _, reply := range replies {
+		response, err := ParseResponse(reply)
+		if err != nil {
+			t.Fatalf("%q: %v", reply, err)
+		}
+		if response.String() != reply {
+			t.Fatalf("got %q, want %q", response.String(), reply)
+		}
+	}
+}
+
+func TestParseDrawResult(t *testing.T) {
+	cases := map[string][]int{
+		"OK: Sorteo realizado | Ganadores:":                  {},
+		"OK: Sorteo realizado | Ganadores:30904465":          {30904465},
+		"OK: Sorteo realizado | Ganadores:30904465,20025664": {30904465, 20025664},
+	}
+	for reply, winners := range cases {
+		response, err := ParseResponse(reply)
+		if err != nil {
+			t.Fatalf("%q: %v", reply, err)
+		}
+		if response.Kind != ResponseDrawResult || !reflect.DeepEqual(response.Draw.Winners, winners) {
+			t.Fatalf("%q: got %+v, want winners %v", reply, response, winners)
+		}
+	}
+}
+
+func TestParseResponseRejectsUnknownReplies(t *testing.T) {
+	for _, reply := range []string{"", "OK", "OK: Otra cosa", "OK: Apuestas recibidas | Cantidad:x", "WELCOME: Version:9", "OK: Sorteo realizado | Ganadores:1,x"} {
+		if _, err := ParseResponse(reply); err == nil {
+			t.Fatalf("%q: expected an error", reply)
+		}
+	}
+}
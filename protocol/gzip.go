@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// FeatureGzip Optional feature to gzip large messages after the handshake
+const FeatureGzip = "gzip"
+
+// maxDecompressedSize Upper bound of a decompressed message, avoids
+// inflating a malicious payload without limit
+const maxDecompressedSize = 16 * maxPayloadSize
+
+// CompressHook Called with the sizes of every compressed message
+type CompressHook func(agencyID int, originalSize int, compressedSize int)
+
+// GzipCodec Wraps a codec compressing every message whose encoding is at
+// least threshold bytes long. The gzipped encoding is sent in a
+// MsgCompressed message of the wrapped codec, which is transparently
+// decompressed when decoding. A message whose compressed frame would not
+// be smaller is sent as is
+type GzipCodec struct {
+	inner      Codec
+	threshold  int
+	onCompress CompressHook
+}
+
+// NewGzipCodec Wraps the codec to compress messages of threshold bytes or
+// more. onCompress may be nil
+func NewGzipCodec(inner Codec, threshold int, onCompress CompressHook) *GzipCodec {
+	return &GzipCodec{inner: inner, threshold: threshold, onCompress: onCompress}
+}
+
+// Encode Encodes the message with the wrapped codec and compresses it if
+// it is large enough and compressing it shrinks it
+func (g *GzipCodec) Encode(msg *Message) ([]byte, error) {
+	data, err := g.inner.Encode(msg)
+	if err != nil || len(data) < g.threshold {
+		return data, err
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	frame, err := g.inner.Encode(&Message{
+		Type:     MsgCompressed,
+		AgencyID: msg.AgencyID,
+		Payload:  compressed.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) >= len(data) {
+		return data, nil
+	}
+	if g.onCompress != nil {
+		g.onCompress(msg.AgencyID, len(data), len(frame))
+	}
+	return frame, nil
+}
+
+// Decode Decodes a message with the wrapped codec, decompressing it if
+// it was sent compressed
+func (g *GzipCodec) Decode(reader *bufio.Reader) (*Message, error) {
+	msg, err := g.inner.Decode(reader)
+	if err != nil || msg.Type != MsgCompressed {
+		return msg, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(msg.Payload))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	data, err := ioutil.ReadAll(&limitedReader{reader: gz, remaining: maxDecompressedSize})
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := g.inner.Decode(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	if inner.Type == MsgCompressed {
+		return nil, fmt.Errorf("nested compressed message")
+	}
+	return inner, nil
+}
+
+// limitedReader Reader that fails once more than remaining bytes are read
+type limitedReader struct {
+	reader    *gzip.Reader
+	remaining int
+}
+
+// Read Reads from the wrapped reader, failing if the limit is exceeded
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.remaining -= n
+	if l.remaining < 0 {
+		return n, fmt.Errorf("decompressed message larger than %d bytes", maxDecompressedSize)
+	}
+	return n, err
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ProtocolVersion Latest protocol version
+const ProtocolVersion = 1
+
+// SupportedVersions Protocol versions spoken by this package
+var SupportedVersions = []int{ProtocolVersion}
+
+// FeatureBinary Optional feature to use the binary format after the handshake
+const FeatureBinary = "binary"
+
+// FeatureHeartbeat Optional feature to send MsgPing heartbeats while
+// waiting for the draw
+const FeatureHeartbeat = "heartbeat"
+
+// FeatureMultiplex Optional feature to carry the messages of several
+// agencies over a single connection. Every server reply is then tagged
+// with the agency it answers, in the AgencyID of the message
+const FeatureMultiplex = "multiplex"
+
+// FeatureSubscribe Optional feature to wait for the draw with a single
+// MsgSubscribe instead of polling with MsgAwaitResults
+const FeatureSubscribe = "subscribe"
+
+// Welcome Server answer to the handshake
+type Welcome struct {
+	Version  int
+	Features []string
+}
+
+// HasFeature Returns true if the server accepted the feature
+func (w *Welcome) HasFeature(feature string) bool {
+	for _, f := range w.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWelcome Parses the fields of the server answer to the handshake,
+// "Version:1 | Features:binary". A version this package does not speak
+// is returned as error
+func parseWelcome(body string) (*Welcome, error) {
+	fields, err := parseReplyFields(body)
+	if err != nil {
+		return nil, err
+	}
+	version, err := strconv.Atoi(fields["Version"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed version in handshake reply: %q", body)
+	}
+	if !SupportsVersion(version) {
+		return nil, fmt.Errorf("server chose unsupported protocol version %d (supported: %v)", version, SupportedVersions)
+	}
+	return &Welcome{Version: version, Features: splitList(fields["Features"])}, nil
+}
+
+// SupportsVersion Returns true if the protocol version is spoken by this package
+func SupportsVersion(version int) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
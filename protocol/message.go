@@ -0,0 +1,82 @@
+package protocol
+
+import "fmt"
+
+// MessageType Kind of message exchanged between client and server
+type MessageType uint8
+
+const (
+	// MsgBets Chunk of bets sent by an agency
+	MsgBets MessageType = iota + 1
+	// MsgAwaitResults Request for the draw results of an agency
+	MsgAwaitResults
+	// MsgResponse Reply sent by the server
+	MsgResponse
+	// MsgHello Handshake sent by an agency right after connecting
+	MsgHello
+	// MsgCompressed Gzipped encoding of another message
+	MsgCompressed
+	// MsgSigned Encoding of another message signed by the agency
+	MsgSigned
+	// MsgPing Heartbeat sent by an agency, answered with a PONG reply
+	MsgPing
+	// MsgSubscribe Request for the draw results of an agency, answered
+	// by the server once the draw is made
+	MsgSubscribe
+)
+
+const (
+	// FormatText Newline delimited text protocol
+	FormatText = "text"
+	// FormatBinary Length-prefixed binary protocol
+	FormatBinary = "binary"
+)
+
+// MaxBetsPerMessage Largest number of bets in a MsgBets message, its
+// count takes 2 bytes in the binary format
+const MaxBetsPerMessage = 0xFFFF
+
+// Message Protocol message exchanged between client and server.
+// Seq and Bets are only used by MsgBets, Text only by MsgResponse,
+// Versions and Features only by MsgHello, Payload by MsgCompressed and
+// MsgSigned and Nonce and MAC only by MsgSigned. A Seq of 0 means the
+// chunk is not numbered
+type Message struct {
+	Type     MessageType
+	AgencyID int
+	Seq      int
+	Bets     []*Bet
+	Text     string
+	Versions []int
+	Features []string
+	Payload  []byte
+	Nonce    []byte
+	MAC      []byte
+}
+
+// Bet struct that represents a bet
+type Bet struct {
+	AgencyID   int // agency number
+	ID         int // bet number
+	Name       string
+	Surname    string
+	PersonalID int
+	BirthDate  string
+}
+
+// ToStr Returns a string representation of the bet. Text fields
+// are escaped so they never break the format (see escapeField)
+func (b *Bet) ToStr() string {
+	return fmt.Sprintf("[AgencyID:%d,ID:%d,Name:%s,Surname:%s,PersonalID:%d,BirthDate:%s]",
+		b.AgencyID, b.ID, escapeField(b.Name), escapeField(b.Surname), b.PersonalID, escapeField(b.BirthDate))
+}
+
+// GetBetID Returns the bet ID
+func (b *Bet) GetBetID() int {
+	return b.ID
+}
+
+// GetPesonalID Returns the personal ID
+func (b *Bet) GetPersonalID() int {
+	return b.PersonalID
+}
@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResponseKind Kind of reply sent by the server
+type ResponseKind int
+
+const (
+	// ResponseBatchAck A chunk of bets was stored
+	ResponseBatchAck ResponseKind = iota + 1
+	// ResponseWait The draw was not made yet
+	ResponseWait
+	// ResponseDrawResult The draw was made, carries the winners of the agency
+	ResponseDrawResult
+	// ResponseError The server rejected the last message
+	ResponseError
+	// ResponseWelcome Answer to the handshake
+	ResponseWelcome
+	// ResponsePong Answer to a heartbeat
+	ResponsePong
+)
+
+// String Returns the name of the kind, used in logs
+func (k ResponseKind) String() string {
+	switch k {
+	case ResponseBatchAck:
+		return "batch_ack"
+	case ResponseWait:
+		return "wait"
+	case ResponseDrawResult:
+		return "draw_result"
+	case ResponseError:
+		return "error"
+	case ResponseWelcome:
+		return "welcome"
+	case ResponsePong:
+		return "pong"
+	}
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+// DrawResult Result of the draw for an agency
+type DrawResult struct {
+	// Winners Personal IDs (DNI) of the winners that bet in the agency
+	Winners []int
+}
+
+// Response Reply sent by the server. Only the fields of its kind are set:
+// Count and Seq (0 if the chunk was not numbered) for BatchAck, Draw for
+// DrawResult, Code for Error, Message for Wait and Error and Welcome for
+// Welcome
+type Response struct {
+	Kind    ResponseKind
+	Count   int
+	Seq     int
+	Draw    *DrawResult
+	Code    string
+	Message string
+	Welcome *Welcome
+}
+
+// Err Returns the error sent by the server in an Error reply
+func (r *Response) Err() error {
+	if r.Code != "" {
+		return fmt.Errorf("server error %s: %s", r.Code, r.Message)
+	}
+	return fmt.Errorf("server error: %s", r.Message)
+}
+
+// String Returns the reply line of the response, as sent by the
+// server, or an empty string for an unknown kind. It is the inverse of
+// ParseResponse
+func (r *Response) String() string {
+	switch r.Kind {
+	case ResponseBatchAck:
+		if r.Seq > 0 {
+			return fmt.Sprintf("OK: Apuestas recibidas | Cantidad:%d | Seq:%d", r.Count, r.Seq)
+		}
+		return fmt.Sprintf("OK: Apuestas recibidas | Cantidad:%d", r.Count)
+	case ResponseWait:
+		return fmt.Sprintf("WAIT: %s", r.Message)
+	case ResponseDrawResult:
+		winners := make([]string, len(r.Draw.Winners))
+		for i, winner := range r.Draw.Winners {
+			winners[i] = strconv.Itoa(winner)
+		}
+		return fmt.Sprintf("OK: Sorteo realizado | Ganadores:%s", strings.Join(winners, ","))
+	case ResponseError:
+		if r.Code != "" {
+			return fmt.Sprintf("ERROR: %s | Code:%s", r.Message, r.Code)
+		}
+		return fmt.Sprintf("ERROR: %s", r.Message)
+	case ResponseWelcome:
+		return fmt.Sprintf("WELCOME: Version:%d | Features:%s", r.Welcome.Version, strings.Join(r.Welcome.Features, ","))
+	case ResponsePong:
+		return "PONG"
+	}
+	return ""
+}
+
+// ParseResponse Parses a server reply. Replies have the form
+// "<STATUS>: <message> | <Key>:<Value> | ...":
+//
+//	OK: Apuestas recibidas | Cantidad:5
+//	OK: Apuestas recibidas | Cantidad:5 | Seq:3
+//	OK: Sorteo realizado | Ganadores:30904465,20025664
+//	WAIT: Esperando a las otras agencias
+//	ERROR: Mensaje no reconocido | Code:unknown_message
+//	WELCOME: Version:1 | Features:binary
+//	PONG
+//
+// The Code of an ERROR and the Seq of a chunk ack are optional. Any
+// other reply is rejected
+func ParseResponse(reply string) (*Response, error) {
+	if reply == "PONG" {
+		return &Response{Kind: ResponsePong}, nil
+	}
+	status, rest, found := cut(reply, ": ")
+	if !found {
+		return nil, fmt.Errorf("malformed server reply: %q", reply)
+	}
+
+	switch status {
+	case "WELCOME":
+		welcome, err := parseWelcome(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Kind: ResponseWelcome, Welcome: welcome}, nil
+	case "WAIT":
+		return &Response{Kind: ResponseWait, Message: rest}, nil
+	}
+
+	message, fields, err := parseReplyBody(rest)
+	if err != nil {
+		return nil, fmt.Errorf("malformed server reply: %q: %v", reply, err)
+	}
+	switch {
+	case status == "ERROR":
+		return &Response{Kind: ResponseError, Code: fields["Code"], Message: message}, nil
+	case status == "OK" && message == "Apuestas recibidas":
+		count, err := strconv.Atoi(fields["Cantidad"])
+		if err != nil {
+			return nil, fmt.Errorf("malformed bets count in server reply: %q", reply)
+		}
+		seq := 0
+		if seqField, ok := fields["Seq"]; ok {
+			seq, err = strconv.Atoi(seqField)
+			if err != nil {
+				return nil, fmt.Errorf("malformed seq in server reply: %q", reply)
+			}
+		}
+		return &Response{Kind: ResponseBatchAck, Count: count, Seq: seq}, nil
+	case status == "OK" && message == "Sorteo realizado":
+		winnersField, ok := fields["Ganadores"]
+		if !ok {
+			return nil, fmt.Errorf("draw result without winners: %q", reply)
+		}
+		winners := []int{}
+		for _, w := range splitList(winnersField) {
+			winner, err := strconv.Atoi(w)
+			if err != nil {
+				return nil, fmt.Errorf("malformed winner in server reply: %q", w)
+			}
+			winners = append(winners, winner)
+		}
+		return &Response{Kind: ResponseDrawResult, Draw: &DrawResult{Winners: winners}}, nil
+	}
+	return nil, fmt.Errorf("unknown server reply: %q", reply)
+}
+
+// parseReplyBody Splits "<message> | <Key>:<Value> | ..." in the
+// message and its fields
+func parseReplyBody(body string) (string, map[string]string, error) {
+	message, rest, found := cut(body, " | ")
+	if !found {
+		return message, map[string]string{}, nil
+	}
+	fields, err := parseReplyFields(rest)
+	return message, fields, err
+}
+
+// cut Slices s around the first instance of sep
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
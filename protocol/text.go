@@ -0,0 +1,334 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TextCodec Codec of the legacy text protocol. Every message is a
+// single line:
+//
+//	[CLIENT <id>] Hello -> Versions:1,2 | Features:binary
+//	[CLIENT <id>] Bets -> [bet1][bet2]...
+//	[CLIENT <id>] Bets Seq:<seq> -> [bet1][bet2]...
+//	[CLIENT <id>] Awaiting results
+//	[CLIENT <id>] Ping
+//	[CLIENT <id>] Subscribe results
+//	[CLIENT <id>] Gzip -> <base64 of the compressed line>
+//	[CLIENT <id>] Signed Nonce:<hex> | HMAC:<hex> -> <signed line>
+//	<server reply>
+//	[AGENCY <id>] <server reply>
+//
+// Replies are only tagged with the agency they answer in multiplexed
+// connections (see FeatureMultiplex). Text fields of the bets are
+// escaped with escapeField
+type TextCodec struct{}
+
+// textReserved Characters with a meaning in the text protocol
+const textReserved = "%,:[]\r\n"
+
+// escapeField Escapes a bet field for the text protocol. Every reserved
+// character (the delimiters ',', ':', '[' and ']', the line breaks and
+// '%' itself) is replaced by '%' followed by its two hex digits, so
+// "Gómez, Ana" is sent as "Gómez%2C Ana". Any other UTF-8 text is sent
+// as is. It is the same percent-encoding used in URLs, which lets the
+// server decode it with urllib.parse.unquote
+func escapeField(field string) string {
+	if !strings.ContainsAny(field, textReserved) {
+		return field
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		if strings.IndexByte(textReserved, field[i]) >= 0 {
+			fmt.Fprintf(&escaped, "%%%02X", field[i])
+		} else {
+			escaped.WriteByte(field[i])
+		}
+	}
+	return escaped.String()
+}
+
+// unescapeField Reverts escapeField. An error is returned if a '%' is
+// not followed by two hex digits
+func unescapeField(field string) (string, error) {
+	if !strings.Contains(field, "%") {
+		return field, nil
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '%' {
+			unescaped.WriteByte(field[i])
+			continue
+		}
+		if i+2 >= len(field) {
+			return "", fmt.Errorf("truncated escape sequence in field: %q", field)
+		}
+		b, err := strconv.ParseUint(field[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in field: %q", field)
+		}
+		unescaped.WriteByte(byte(b))
+		i += 2
+	}
+	return unescaped.String(), nil
+}
+
+// Encode Returns the text line of the message
+func (TextCodec) Encode(msg *Message) ([]byte, error) {
+	var line string
+	switch msg.Type {
+	case MsgBets:
+		betStrings := make([]string, len(msg.Bets))
+		for i, bet := range msg.Bets {
+			betStrings[i] = bet.ToStr()
+		}
+		if msg.Seq > 0 {
+			line = fmt.Sprintf("[CLIENT %v] Bets Seq:%d -> %s", msg.AgencyID, msg.Seq, strings.Join(betStrings, ""))
+		} else {
+			line = fmt.Sprintf("[CLIENT %v] Bets -> %s", msg.AgencyID, strings.Join(betStrings, ""))
+		}
+	case MsgAwaitResults:
+		line = fmt.Sprintf("[CLIENT %v] Awaiting results", msg.AgencyID)
+	case MsgPing:
+		line = fmt.Sprintf("[CLIENT %v] Ping", msg.AgencyID)
+	case MsgSubscribe:
+		line = fmt.Sprintf("[CLIENT %v] Subscribe results", msg.AgencyID)
+	case MsgResponse:
+		line = msg.Text
+		if msg.AgencyID != 0 {
+			line = fmt.Sprintf("[AGENCY %v] %s", msg.AgencyID, msg.Text)
+		}
+	case MsgHello:
+		versions := make([]string, len(msg.Versions))
+		for i, version := range msg.Versions {
+			versions[i] = strconv.Itoa(version)
+		}
+		line = fmt.Sprintf("[CLIENT %v] Hello -> Versions:%s | Features:%s",
+			msg.AgencyID, strings.Join(versions, ","), strings.Join(msg.Features, ","))
+	case MsgCompressed:
+		line = fmt.Sprintf("[CLIENT %v] Gzip -> %s", msg.AgencyID, base64.StdEncoding.EncodeToString(msg.Payload))
+	case MsgSigned:
+		signed := strings.TrimSuffix(string(msg.Payload), "\n")
+		if strings.ContainsAny(signed, "\n") {
+			return nil, fmt.Errorf("signed payload is not a single line")
+		}
+		line = fmt.Sprintf("[CLIENT %v] Signed Nonce:%x | HMAC:%x -> %s", msg.AgencyID, msg.Nonce, msg.MAC, signed)
+	default:
+		return nil, fmt.Errorf("unknown message type: %d", msg.Type)
+	}
+	return []byte(line + "\n"), nil
+}
+
+// Decode Reads a line and parses it. Lines that are not tagged
+// with the agency of a client are considered server replies
+func (TextCodec) Decode(reader *bufio.Reader) (*Message, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	if strings.HasPrefix(line, "[AGENCY ") {
+		return parseTaggedReply(line)
+	}
+	if !strings.HasPrefix(line, "[CLIENT ") {
+		return &Message{Type: MsgResponse, Text: line}, nil
+	}
+	end := strings.Index(line, "] ")
+	if end < 0 {
+		return nil, fmt.Errorf("malformed message: %q", line)
+	}
+	agencyID, err := strconv.Atoi(line[len("[CLIENT "):end])
+	if err != nil {
+		return nil, fmt.Errorf("malformed agency id: %v", err)
+	}
+	body := line[end+len("] "):]
+
+	if body == "Awaiting results" {
+		return &Message{Type: MsgAwaitResults, AgencyID: agencyID}, nil
+	}
+	if body == "Ping" {
+		return &Message{Type: MsgPing, AgencyID: agencyID}, nil
+	}
+	if body == "Subscribe results" {
+		return &Message{Type: MsgSubscribe, AgencyID: agencyID}, nil
+	}
+	if strings.HasPrefix(body, "Signed ") {
+		return parseSigned(agencyID, body)
+	}
+	if strings.HasPrefix(body, "Gzip -> ") {
+		payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body, "Gzip -> "))
+		if err != nil {
+			return nil, fmt.Errorf("malformed compressed message: %v", err)
+		}
+		return &Message{Type: MsgCompressed, AgencyID: agencyID, Payload: payload}, nil
+	}
+	if strings.HasPrefix(body, "Hello -> ") {
+		versions, features, err := parseHello(strings.TrimPrefix(body, "Hello -> "))
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Type: MsgHello, AgencyID: agencyID, Versions: versions, Features: features}, nil
+	}
+	if !strings.HasPrefix(body, "Bets ") {
+		return nil, fmt.Errorf("unknown message: %q", line)
+	}
+	header, betsStr, found := cut(body, " -> ")
+	if !found {
+		return nil, fmt.Errorf("malformed message: %q", line)
+	}
+	seq := 0
+	if header != "Bets" {
+		seq, err = strconv.Atoi(strings.TrimPrefix(header, "Bets Seq:"))
+		if err != nil || !strings.HasPrefix(header, "Bets Seq:") {
+			return nil, fmt.Errorf("malformed bets header: %q", header)
+		}
+	}
+	bets, err := parseTextBets(agencyID, betsStr)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgBets, AgencyID: agencyID, Seq: seq, Bets: bets}, nil
+}
+
+// parseTaggedReply Parses a "[AGENCY <id>] <reply>" server reply
+func parseTaggedReply(line string) (*Message, error) {
+	tag, text, found := cut(line, "] ")
+	if !found {
+		return nil, fmt.Errorf("malformed reply: %q", line)
+	}
+	agencyID, err := strconv.Atoi(strings.TrimPrefix(tag, "[AGENCY "))
+	if err != nil {
+		return nil, fmt.Errorf("malformed agency id: %v", err)
+	}
+	return &Message{Type: MsgResponse, AgencyID: agencyID, Text: text}, nil
+}
+
+// parseSigned Parses a "Signed Nonce:<hex> | HMAC:<hex> -> <line>" message.
+// The payload is the signed line with its line break, as it was encoded
+func parseSigned(agencyID int, body string) (*Message, error) {
+	header, signed, found := cut(strings.TrimPrefix(body, "Signed "), " -> ")
+	if !found {
+		return nil, fmt.Errorf("malformed signed message: %q", body)
+	}
+	fields, err := parseReplyFields(header)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(fields["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed nonce: %v", err)
+	}
+	mac, err := hex.DecodeString(fields["HMAC"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed HMAC: %v", err)
+	}
+	return &Message{
+		Type:     MsgSigned,
+		AgencyID: agencyID,
+		Nonce:    nonce,
+		MAC:      mac,
+		Payload:  []byte(signed + "\n"),
+	}, nil
+}
+
+// parseHello Parses a "Versions:1,2 | Features:binary" handshake
+func parseHello(s string) ([]int, []string, error) {
+	fields, err := parseReplyFields(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	versionsField, ok := fields["Versions"]
+	if !ok || versionsField == "" {
+		return nil, nil, fmt.Errorf("hello without versions: %q", s)
+	}
+	var versions []int
+	for _, v := range strings.Split(versionsField, ",") {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed version in hello: %q", v)
+		}
+		versions = append(versions, version)
+	}
+	return versions, splitList(fields["Features"]), nil
+}
+
+// parseReplyFields Parses a list of "Key:Value" pairs separated by " | "
+func parseReplyFields(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(s, " | ") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed field: %q", pair)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields, nil
+}
+
+// splitList Splits a comma separated list. An empty string
+// is an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// parseTextBets Parses a "[bet1][bet2]..." list
+func parseTextBets(agencyID int, s string) ([]*Bet, error) {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("malformed bets: %q", s)
+	}
+	s = s[1 : len(s)-1]
+	parts := strings.Split(s, "][")
+	bets := make([]*Bet, 0, len(parts))
+	for _, part := range parts {
+		bet, err := parseTextBet(part)
+		if err != nil {
+			return nil, err
+		}
+		bet.AgencyID = agencyID
+		bets = append(bets, bet)
+	}
+	return bets, nil
+}
+
+// parseTextBet Parses the fields of a bet, formatted by Bet.ToStr
+func parseTextBet(s string) (*Bet, error) {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed bet field: %q", pair)
+		}
+		value, err := unescapeField(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		fields[kv[0]] = value
+	}
+	id, err := strconv.Atoi(fields["ID"])
+	if err != nil {
+		return nil, fmt.Errorf("error converting id to int: %v", err)
+	}
+	personalID, err := strconv.Atoi(fields["PersonalID"])
+	if err != nil {
+		return nil, fmt.Errorf("error converting personalID to int: %v", err)
+	}
+	return &Bet{
+		ID:         id,
+		Name:       fields["Name"],
+		Surname:    fields["Surname"],
+		PersonalID: personalID,
+		BirthDate:  fields["BirthDate"],
+	}, nil
+}
@@ -1,23 +1,31 @@
 import socket
+import time
+import select
 import logging
-from common.utils import parse_bets, store_bets, load_bets, has_won
+from common.utils import store_bets, chunk_digest, load_bets, has_won, parse_message, inflate, decode_frame, encode_frame, frame_length, parse_signed, parse_signed_frame, verify_signature, Message, UnknownMessage, AuthError, AUTH_BAD_SIGNATURE, AUTH_EXPIRED_NONCE, AUTH_REPLAYED_NONCE, BINARY_HEADER_SIZE, MAX_PAYLOAD_SIZE, BETS, AWAIT_RESULTS, RESPONSE, HELLO, COMPRESSED, SIGNED, PING, SUBSCRIBE
 from multiprocessing import Process, Manager, Lock, Semaphore
 from os import kill
 from signal import SIGTERM
 
 AGENCIES_DONE = "AGENCIES_DONE"
 SAVE_BETS = "SAVE_BETS"
+AUTH = "AUTH"
 MAX_TRIES = 10
 MAX_THREADS = 5 # In this case is the number of agencies
+SUPPORTED_VERSIONS = {1}
+SUPPORTED_FEATURES = {"auth", "binary", "gzip", "heartbeat", "subscribe", "multiplex"}
+SUBSCRIBE_POLL_INTERVAL = 0.1 # Seconds between checks of the draw while agencies are subscribed
 
 
 class Server:
-    def __init__(self, port, listen_backlog, n_agencies):
+    def __init__(self, port, listen_backlog, n_agencies, auth_secrets, auth_max_age):
         # Initialize server socket
         self._server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
         self._server_socket.bind(('', port))
         self._server_socket.listen(listen_backlog)
         self._n_agencies = n_agencies
+        self._auth_secrets = auth_secrets # agency -> secret, their messages must be signed
+        self._auth_max_age = auth_max_age * 10**9 # nanoseconds
         self._manager = Manager()
         self._agencies_done = {}
 
@@ -27,7 +35,10 @@ class Server:
             self._processes = manager.list()  # shared list
             self._agencies_done = manager.dict()  # shared dict
             self._winners = manager.list()  # shared list
-            locks = {AGENCIES_DONE: Lock(), SAVE_BETS: Lock()}
+            self._chunks = manager.dict()  # shared dict, "agency|seq" -> digest of the bets of the chunk stored with that seq
+            self._nonces = manager.dict()  # shared dict, nonces seen in the last auth_max_age
+            self._nonces_purge = manager.Value('q', time.time_ns())  # last purge of the nonces
+            locks = {AGENCIES_DONE: Lock(), SAVE_BETS: Lock(), AUTH: Lock()}
             semaphore = Semaphore(MAX_THREADS)
 
             for i in range(self._n_agencies):
@@ -46,59 +57,274 @@ class Server:
 
         If a problem arises in the communication with the client, the
         client socket will also be closed
+
+        Every message is answered in its own format: binary frames are
+        decoded to the same messages as text lines and their replies are
+        sent as binary frames
+
+        A multiplexed connection carries the messages of several agencies,
+        so every reply is tagged with the agency it answers and the
+        connection is kept open after the draw until the client closes it
         """
         client_sock = socket.fromfd(client_sock_fd, socket.AF_INET, socket.SOCK_STREAM)
         self._connections.append(client_sock.fileno())
-        msg_buffer = ""
-        msg, msg_buffer = self.__receive_line(client_sock, msg_buffer)
+        msg_buffer = b""
         not_break = True
-        personal_ids = set()
-        while msg and not_break:
-            if "Bets" in msg:
-                not_break = self.__manage_new_bets(msg, client_sock, personal_ids, locks[SAVE_BETS])
-            elif "Awaiting results" in msg:
-                agency = self.__get_agency_from_msg(msg)
-                not_break = self.__manage_results(client_sock, agency, personal_ids, locks[AGENCIES_DONE], locks[SAVE_BETS])
-            else:
-                self.__send_message(client_sock, "ERROR: Mensaje no reconocido")
-            msg, msg_buffer = self.__receive_line(client_sock, msg_buffer)
+        multiplexed = False
+        subscribers = {} # agency -> reply function, agencies waiting for the draw
+        while not_break:
+            if subscribers:
+                if self.__draw_done(locks[AGENCIES_DONE]):
+                    for agency, reply in subscribers.items():
+                        self.__manage_results(reply, agency, locks[AGENCIES_DONE], locks[SAVE_BETS])
+                    subscribers.clear()
+                    not_break = multiplexed
+                    continue
+                if not self.__wait_message(client_sock, msg_buffer):
+                    continue
+            msg, binary, msg_buffer = self.__receive_message(client_sock, msg_buffer, locks[AUTH])
+            if not msg:
+                break
+            try:
+                message = decode_frame(msg) if binary else parse_message(msg)
+                if message.kind == COMPRESSED:
+                    message = self.__decompress(message, binary)
+            except UnknownMessage as e:
+                self.__replier(client_sock, e.agency, multiplexed, binary)("ERROR: Mensaje no reconocido")
+                continue
+            except Exception as e:
+                logging.error(f'action: parse_message | result: fail | error: {e} | msg: {msg}')
+                self.__replier(client_sock, 0, False, binary)("ERROR: Error al parsear el mensaje")
+                break
+            reply = self.__replier(client_sock, message.agency, multiplexed, binary)
+            if message.kind == PING:
+                reply("PONG")
+            elif message.kind == HELLO:
+                not_break, multiplexed = self.__manage_hello(message, reply)
+            elif message.kind == BETS:
+                not_break = self.__manage_new_bets(message, reply, locks[SAVE_BETS])
+            elif message.kind == SUBSCRIBE:
+                with locks[AGENCIES_DONE]:
+                    self._agencies_done[message.agency] = True
+                subscribers[message.agency] = reply
+            elif message.kind == AWAIT_RESULTS:
+                not_break = self.__manage_results(reply, message.agency, locks[AGENCIES_DONE], locks[SAVE_BETS]) or multiplexed
         self.__close_client_connection(client_sock.fileno())
         semaphore.release()
-            
 
-    def __manage_new_bets(self, msg, client_sock, personal_ids, save_bets_lock):
-        try:
-            bets = parse_bets(msg)
-        except Exception as e:
-            logging.error(f'action: parse_bets | result: fail | error: {e} | msg: {msg}')
-            self.__send_message(client_sock, "ERROR: Error al parsear las apuestas")
-            return False
-        self.__send_message(client_sock, f"OK: Apuestas recibidas | Cantidad:{len(bets)}")
+    def __replier(self, client_sock, agency, multiplexed, binary):
+        """
+        Returns the function that replies to a message in its format,
+        which tags the reply with the agency of the message in
+        multiplexed connections (in the header of the frame in the binary
+        format)
+        """
+        if binary:
+            agency = agency if multiplexed else 0
+            return lambda reply: self.__send_bytes(client_sock, encode_frame(Message(RESPONSE, agency, text=reply)))
+        if not multiplexed:
+            return lambda reply: self.__send_message(client_sock, reply)
+        return lambda reply: self.__send_message(client_sock, f"[AGENCY {agency}] {reply}")
+
+    def __decompress(self, message, binary):
+        """
+        Returns the message carried by a compressed one, which must belong
+        to the same agency
+        """
+        data = inflate(message.payload)
+        inner = decode_frame(data) if binary else parse_message(data.decode('utf-8').rstrip("\n"))
+        if inner.agency != message.agency or inner.kind == COMPRESSED:
+            raise ValueError(f"invalid compressed message of agency {message.agency}")
+        return inner
+
+    def __wait_message(self, client_sock, msg_buffer):
+        """
+        Waits up to SUBSCRIBE_POLL_INTERVAL for a message from the client.
+        Returns whether there is one to read
+        """
+        if self.__has_message(msg_buffer):
+            return True
+        readable, _, _ = select.select([client_sock], [], [], SUBSCRIBE_POLL_INTERVAL)
+        return bool(readable)
+
+    def __manage_new_bets(self, message, reply, save_bets_lock):
+        """
+        Stores a chunk of bets and acks it once stored. A numbered chunk
+        whose seq was already stored with the same bets was sent again
+        because its ack was lost, so it is only acked. A different chunk
+        with the same seq (e.g. of another run of the client) is stored
+        """
+        bets = message.bets
+        key = f"{message.agency}|{message.seq}"
+        digest = chunk_digest(bets)
         with save_bets_lock:
-            store_bets(bets)
-            for bet in bets:
-                personal_ids.add(bet.document)
+            repeated = message.seq is not None and self._chunks.get(key) == digest
+            if not repeated:
+                store_bets(bets)
+                if message.seq is not None:
+                    self._chunks[key] = digest
+        ack = f"OK: Apuestas recibidas | Cantidad:{len(bets)}"
+        if message.seq is not None:
+            ack += f" | Seq:{message.seq}"
+        reply(ack)
+        if repeated:
+            logging.info(f'action: apuestas_repetidas | result: success | agency: {message.agency} | seq: {message.seq} | cantidad: {len(bets)}')
+            return True
         for bet in bets:
             logging.info(f'action: apuesta_almacenada | result: success | dni: {bet.document} | numero: {bet.number}')
         return True
 
-    def __manage_results(self, client_sock, agency, personal_ids, agencies_done_lock, save_bets_lock):
+    def __manage_hello(self, message, reply):
+        """
+        Answers the handshake with the highest protocol version spoken by
+        both sides and the optional features the server accepts. Returns
+        whether the connection goes on and whether it is multiplexed
+        """
+        versions, features = message.versions, message.features
+        common_versions = SUPPORTED_VERSIONS & versions
+        if not common_versions:
+            logging.error(f'action: handshake | result: fail | error: no common version | agency: {message.agency}')
+            reply("ERROR: Version no soportada")
+            return False, False
+        if message.agency in self._auth_secrets and "auth" not in features:
+            logging.error(f'action: handshake | result: fail | error: auth not requested | agency: {message.agency}')
+            reply(AuthError(message.agency, AUTH_BAD_SIGNATURE).reply())
+            return False, False
+        version = max(common_versions)
+        accepted = SUPPORTED_FEATURES & features
+        reply(f"WELCOME: Version:{version} | Features:{','.join(sorted(accepted))}")
+        return True, "multiplex" in accepted
+
+    def __manage_results(self, reply, agency, agencies_done_lock, save_bets_lock):
+        """
+        Answers a results query with the winners of the agency, which are
+        looked up among all its stored bets, so they do not depend on the
+        connection through which the bets were sent
+        """
         with agencies_done_lock:
             self._agencies_done[agency] = True
             all_done = self.__all_agencies_done()
         if not all_done:
-            self.__send_message(client_sock, "WAIT: Esperando a las otras agencias")
+            reply("WAIT: Esperando a las otras agencias")
             return True
         with save_bets_lock:
             winners = self.__get_winners()
-            agency_winners = []
-            for winner in winners:
-                if winner in personal_ids:
-                    agency_winners.append(winner)
+            # An unnumbered chunk sent again after a reconnection may be stored twice
+            agency_winners = dict.fromkeys(document for winner_agency, document in winners if winner_agency == agency)
         agency_winners = ','.join(agency_winners)
-        self.__send_message(client_sock, f"OK: Sorteo realizado | Ganadores:{agency_winners}")
+        reply(f"OK: Sorteo realizado | Ganadores:{agency_winners}")
         return False
 
+    def __draw_done(self, agencies_done_lock):
+        """
+        Checks if every agency finished sending bets, so the draw can be made
+        """
+        with agencies_done_lock:
+            return self.__all_agencies_done()
+
+    def __has_message(self, msg_buffer):
+        """
+        Checks whether the buffer already holds a whole message
+        """
+        if msg_buffer.startswith(b"["):
+            return b"\n" in msg_buffer
+        length = frame_length(msg_buffer)
+        return length is not None and len(msg_buffer) >= length
+
+    def __receive_message(self, client_sock, msg_buffer, auth_lock):
+        """
+        Read a message from a specific client socket, a text line or a
+        binary frame. Returns whether it was a binary frame too
+
+        Text lines start with the '[' of the agency tag and binary frames
+        with their type, so the first byte tells them apart. A message
+        that can not be authenticated is answered with the error and
+        ends the connection
+        """
+        if not msg_buffer:
+            try:
+                msg_buffer = self.__receive_chunk(client_sock, msg_buffer)
+            except OSError as e:
+                logging.error(f'action: receive_message | result: fail | error: {e}')
+                return None, False, b""
+            if msg_buffer is None:
+                return None, False, b""
+        binary = not msg_buffer.startswith(b"[")
+        if binary:
+            msg, msg_buffer = self.__receive_frame(client_sock, msg_buffer)
+        else:
+            msg, msg_buffer = self.__receive_line(client_sock, msg_buffer)
+        if not msg:
+            return None, binary, msg_buffer
+        try:
+            return self.__authenticate(msg, binary, auth_lock), binary, msg_buffer
+        except AuthError as e:
+            logging.error(f'action: authenticate | result: fail | agency: {e.agency} | error: {e.code}')
+            self.__replier(client_sock, e.agency, False, binary)(e.reply())
+        except Exception as e:
+            logging.error(f'action: receive_message | result: fail | error: {e}')
+        return None, binary, msg_buffer
+
+    def __authenticate(self, msg, binary, auth_lock):
+        """
+        Returns the message carried by a signed one, a line or a frame
+        as the signed message. Every message of an agency with a secret
+        must be signed, except the handshake, in which it must request
+        the auth feature
+        """
+        signed = parse_signed_frame(msg) if binary else parse_signed(msg)
+        if signed is None:
+            if self._auth_secrets:
+                agency = int.from_bytes(msg[5:9], 'big') if binary else self.__get_agency_from_msg(msg)
+                hello = not binary and msg.partition("] ")[2].startswith("Hello ->")
+                if agency in self._auth_secrets and not hello:
+                    raise AuthError(agency, AUTH_BAD_SIGNATURE)
+            return msg
+        agency, nonce, mac, payload = signed
+        self.__verify(agency, nonce, mac, payload, auth_lock)
+        if binary:
+            if len(payload) < BINARY_HEADER_SIZE or payload[0] == SIGNED or int.from_bytes(payload[5:9], 'big') != agency:
+                raise AuthError(agency, AUTH_BAD_SIGNATURE)
+            return payload
+        inner = payload.decode('utf-8').rstrip("\n")
+        if not inner.startswith(f"[CLIENT {agency}] ") or parse_signed(inner) is not None:
+            raise AuthError(agency, AUTH_BAD_SIGNATURE)
+        return inner
+
+    def __verify(self, agency, nonce, mac, payload, auth_lock):
+        """
+        Checks the signature of a signed message and that its nonce was
+        sent less than auth_max_age ago and was not seen before. Nonces
+        are remembered by every process for auth_max_age, older ones are
+        rejected by their time
+        """
+        sent = verify_signature(self._auth_secrets, agency, nonce, mac, payload)
+        now = time.time_ns()
+        if abs(now - sent) > self._auth_max_age:
+            raise AuthError(agency, AUTH_EXPIRED_NONCE)
+        key = f"{agency}|{nonce.hex()}"
+        with auth_lock:
+            if key in self._nonces:
+                raise AuthError(agency, AUTH_REPLAYED_NONCE)
+            self._nonces[key] = sent
+            if now - self._nonces_purge.value > self._auth_max_age:
+                for old_key, old_sent in self._nonces.items():
+                    if now - old_sent > self._auth_max_age:
+                        del self._nonces[old_key]
+                self._nonces_purge.value = now
+
+    def __receive_chunk(self, client_sock, msg_buffer):
+        """
+        Appends the next chunk read from the client socket to the buffer.
+        Returns None if the connection was closed
+        """
+        for _ in range(MAX_TRIES):
+            chunk = client_sock.recv(1024)
+            if chunk:
+                return msg_buffer + chunk
+        logging.error(f'action: receive_message | result: fail | error: connection closed')
+        return None
+
     def __receive_line(self, client_sock, msg_buffer):
         """
         Read a line message from a specific client socket
@@ -109,24 +335,44 @@ class Server:
         It also avoids short-writes
         """
         try:
-            tries = 0
-            last_buffer = msg_buffer
-            while not "\n" in last_buffer:
-                tries += 1
-                chunk = client_sock.recv(1024)
-                if not chunk and tries == MAX_TRIES:
-                    logging.error(f'action: receive_message | result: fail | error: connection closed')
-                    return None, msg_buffer
-                elif not chunk:
-                    continue
-                last_buffer = chunk.decode('utf-8') # to check efficiently if there is a '\n' in the chunk (in utf-8 it is just a byte)
-                msg_buffer += last_buffer
-            msg, _, msg_buffer = msg_buffer.partition("\n")
+            while not b"\n" in msg_buffer:
+                msg_buffer = self.__receive_chunk(client_sock, msg_buffer)
+                if msg_buffer is None:
+                    return None, b""
+            # Only whole lines are decoded, a chunk may end in the middle of a multi-byte character
+            msg, _, msg_buffer = msg_buffer.partition(b"\n")
+            msg = msg.decode('utf-8')
             logging.info(f'action: receive_message | result: success | ip: {client_sock.getpeername()[0]} | msg: {msg}')
             return msg.rstrip(), msg_buffer
         except OSError as e:
             logging.error(f'action: receive_message | result: fail | error: {e}')
             return None, msg_buffer
+
+    def __receive_frame(self, client_sock, msg_buffer):
+        """
+        Read a binary frame from a specific client socket
+
+        If a problem arises in the communication with the client, the
+        client socket will also be closed
+
+        It also avoids short-reads
+        """
+        try:
+            length = frame_length(msg_buffer)
+            while length is None or len(msg_buffer) < length:
+                if length is not None and length > BINARY_HEADER_SIZE + MAX_PAYLOAD_SIZE:
+                    logging.error(f'action: receive_message | result: fail | error: payload too large: {length - BINARY_HEADER_SIZE} bytes')
+                    return None, msg_buffer
+                msg_buffer = self.__receive_chunk(client_sock, msg_buffer)
+                if msg_buffer is None:
+                    return None, b""
+                length = frame_length(msg_buffer)
+            frame, msg_buffer = msg_buffer[:length], msg_buffer[length:]
+            logging.info(f'action: receive_message | result: success | ip: {client_sock.getpeername()[0]} | type: {frame[0]} | size: {length}')
+            return frame, msg_buffer
+        except OSError as e:
+            logging.error(f'action: receive_message | result: fail | error: {e}')
+            return None, msg_buffer
     
     def __send_message(self, client_sock, msg):
         """
@@ -137,7 +383,12 @@ class Server:
 
         It also avoids short-reads
         """
-        msg = "{}\n".format(msg).encode('utf-8')
+        self.__send_bytes(client_sock, "{}\n".format(msg).encode('utf-8'))
+
+    def __send_bytes(self, client_sock, msg):
+        """
+        Send a whole encoded message to a specific client socket
+        """
         total_sent = 0
         while total_sent < len(msg):
             sent = client_sock.send(msg[total_sent:])
@@ -187,12 +438,12 @@ class Server:
     
     def __get_winners(self):
         """
-        Returns the winners of the lottery
+        Returns the winners of the lottery as (agency, document) pairs
         """
         if not self._winners:
             for bet in load_bets():
                 if has_won(bet):
-                    self._winners.append(bet.document)
+                    self._winners.append((bet.agency, bet.document))
             logging.info(f'action: sorteo | result: success | cant_ganadores: {len(self._winners)}')
         return self._winners
     
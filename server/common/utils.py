@@ -1,6 +1,11 @@
+import base64
 import csv
 import datetime
+import gzip
+import hashlib
+import hmac
 import time
+from urllib.parse import unquote
 
 
 """ Bets storage location. """
@@ -49,22 +54,300 @@ def load_bets() -> list[Bet]:
         for row in reader:
             yield Bet(row[0], row[1], row[2], row[3], row[4], row[5])
 
+"""
+Returns a digest of the bets of a chunk, which tells a chunk sent again from a different one.
+"""
+def chunk_digest(bets: list[Bet]) -> str:
+    digest = hashlib.sha256()
+    for bet in bets:
+        digest.update(f"{bet.agency},{bet.first_name},{bet.last_name},{bet.document},{bet.birthdate},{bet.number}\n".encode('utf-8'))
+    return digest.hexdigest()
+
 """
 Parses a string to a Bet object.
 Example of string: "[AgencyID:000,ID:7577,Name:SantiagoLionel,Surname:Lorca,PersonalID:30904465,BirthDate:1999-03-17]"
 Agency is the number of the client.
+Values are percent-encoded by the client ("Gómez, Ana" is sent as "Gómez%2C Ana").
 """
 def parse_bet(bet_str: str) -> Bet:
-    bet_data = dict([pair.split(":") for pair in bet_str.split(",")])
+    bet_data = dict([(key, unquote(value)) for key, value in [pair.split(":") for pair in bet_str.split(",")]])
     return Bet(bet_data["AgencyID"], bet_data["Name"], bet_data["Surname"], bet_data["PersonalID"], bet_data["BirthDate"], bet_data["ID"])
 
 """
 Parses a string to a list of Bet objects.
-Example of string: "Bets -> [bet1][bet2][bet3]"
+Example of string: "Bets -> [bet1][bet2][bet3]" or "Bets Seq:3 -> [bet1][bet2][bet3]"
 """
 def parse_bets(bets_str: str) -> list[Bet]:
-    bets_str = bets_str.split("Bets -> ")
+    bets_str = bets_str.split(" -> ", 1)
     if len(bets_str) != 2:
         return []
     bets_str = bets_str[1][1:-1]
-    return [parse_bet(bet_str) for bet_str in bets_str.split("][")]
\ No newline at end of file
+    return [parse_bet(bet_str) for bet_str in bets_str.split("][")]
+
+"""
+Parses the sequence number of a chunk of bets, None if the chunk is not numbered.
+Example of string: "[CLIENT 1] Bets Seq:3 -> [bet1][bet2][bet3]"
+"""
+def parse_seq(bets_str: str):
+    header = bets_str.split(" -> ", 1)[0]
+    for token in header.split(" "):
+        if token.startswith("Seq:"):
+            return int(token[len("Seq:"):])
+    return None
+
+""" Kinds of the messages, numbered as the message types of the binary format. """
+BETS = 1
+AWAIT_RESULTS = 2
+RESPONSE = 3
+HELLO = 4
+COMPRESSED = 5
+PING = 7
+SUBSCRIBE = 8
+
+""" A protocol message. Only the fields of its kind are set. """
+class Message:
+    def __init__(self, kind: int, agency: int, seq=None, bets=None, versions=None, features=None, payload=b"", text=""):
+        """
+        seq and bets are set for BETS (seq is None if the chunk is not numbered),
+        versions and features for HELLO, payload for COMPRESSED and text for RESPONSE.
+        """
+        self.kind = kind
+        self.agency = agency
+        self.text = text
+        self.seq = seq
+        self.bets = bets if bets is not None else []
+        self.versions = versions if versions is not None else set()
+        self.features = features if features is not None else set()
+        self.payload = payload
+
+""" Raised for a message of an agency whose header is not known. """
+class UnknownMessage(ValueError):
+    def __init__(self, agency: int, header: str):
+        super().__init__(f"unknown header: {header}")
+        self.agency = agency
+
+"""
+Parses a message. Its kind is decided by its header, the text between the
+agency tag and " -> ", so the values of the bets never change it.
+Example of string: "[CLIENT 1] Bets Seq:3 -> [bet1][bet2][bet3]"
+"""
+def parse_message(msg: str) -> Message:
+    tag, separator, body = msg.partition("] ")
+    if not tag.startswith("[CLIENT ") or not separator:
+        raise ValueError(f"message without agency tag: {msg}")
+    agency = int(tag[len("[CLIENT "):])
+    header, _, payload = body.partition(" -> ")
+    if header == "Ping":
+        return Message(PING, agency)
+    if header == "Awaiting results":
+        return Message(AWAIT_RESULTS, agency)
+    if header == "Subscribe results":
+        return Message(SUBSCRIBE, agency)
+    if header == "Hello":
+        versions, features = parse_hello(msg)
+        return Message(HELLO, agency, versions=versions, features=features)
+    if header == "Bets" or header.startswith("Bets "):
+        return Message(BETS, agency, seq=parse_seq(msg), bets=parse_bets(msg))
+    if header == "Gzip":
+        return Message(COMPRESSED, agency, payload=base64.b64decode(payload))
+    raise UnknownMessage(agency, header)
+
+"""
+Returns the encoding of the message carried by the payload of a compressed message.
+"""
+def inflate(payload: bytes) -> bytes:
+    return gzip.decompress(payload)
+
+"""
+Returns the original message of a compressed one.
+The payload is the base64 of the gzipped message line.
+Example of string: "[CLIENT 1] Gzip -> H4sIAAAAAAAA/..."
+"""
+def decompress_message(msg: str) -> str:
+    return inflate(parse_message(msg).payload).decode('utf-8').rstrip("\n")
+
+"""
+Parses a handshake to the protocol versions and features requested by the client.
+Example of string: "[CLIENT 1] Hello -> Versions:1,2 | Features:binary"
+"""
+def parse_hello(hello_str: str) -> tuple[set[int], set[str]]:
+    hello_str = hello_str.split("Hello -> ")[1]
+    fields = dict([pair.split(":", 1) for pair in hello_str.split(" | ")])
+    versions = {int(version) for version in fields["Versions"].split(",")}
+    features = {feature for feature in fields.get("Features", "").split(",") if feature}
+    return versions, features
+
+""" Size of the header of a binary frame: type (1 byte), payload length (4 bytes) and agency (4 bytes). """
+BINARY_HEADER_SIZE = 9
+""" Upper bound of a binary payload, avoids buffering a corrupted frame without limit. """
+MAX_PAYLOAD_SIZE = 1 << 20
+
+""" Type of the binary frames of signed messages. """
+SIGNED = 6
+
+"""
+Returns the size of the binary frame at the start of the buffer, None if its header is not complete yet.
+"""
+def frame_length(buffer: bytes):
+    if len(buffer) < BINARY_HEADER_SIZE:
+        return None
+    return BINARY_HEADER_SIZE + int.from_bytes(buffer[1:5], 'big')
+
+"""
+Parses a whole binary frame (big endian):
+| type (1 byte) | payload length (4 bytes) | agency (4 bytes) | payload |
+The payload of BETS is the chunk seq (4 bytes, 0 if it is not numbered) and a bet
+count (2 bytes) followed by every bet as number (4 bytes), document (4 bytes) and
+first name, last name and birthdate, each one prefixed by its length (2 bytes).
+AWAIT_RESULTS, PING and SUBSCRIBE have no payload, the payload of RESPONSE is the
+text of the reply and the payload of COMPRESSED is the gzipped frame of another message.
+"""
+def decode_frame(frame: bytes) -> Message:
+    length = frame_length(frame)
+    if length is None or length != len(frame):
+        raise ValueError(f"truncated frame of {len(frame)} bytes")
+    kind = frame[0]
+    agency = int.from_bytes(frame[5:9], 'big')
+    payload = frame[BINARY_HEADER_SIZE:]
+    if kind == BETS:
+        seq, bets = _decode_bets(agency, payload)
+        return Message(BETS, agency, seq=seq, bets=bets)
+    if kind in (AWAIT_RESULTS, PING, SUBSCRIBE):
+        return Message(kind, agency)
+    if kind == RESPONSE:
+        return Message(RESPONSE, agency, text=payload.decode('utf-8'))
+    if kind == COMPRESSED:
+        return Message(COMPRESSED, agency, payload=payload)
+    raise UnknownMessage(agency, f"type {kind}")
+
+"""
+Parses the payload of a BETS frame to its seq (None if it is not numbered) and its bets.
+"""
+def _decode_bets(agency: int, payload: bytes):
+    if len(payload) < 6:
+        raise ValueError("truncated bets payload")
+    seq = int.from_bytes(payload[0:4], 'big')
+    count = int.from_bytes(payload[4:6], 'big')
+    offset = 6
+    bets = []
+    for _ in range(count):
+        if len(payload) < offset + 8:
+            raise ValueError("truncated bets payload")
+        number = int.from_bytes(payload[offset:offset + 4], 'big')
+        document = int.from_bytes(payload[offset + 4:offset + 8], 'big')
+        offset += 8
+        fields = []
+        for _ in range(3):
+            if len(payload) < offset + 2:
+                raise ValueError("truncated bets payload")
+            size = int.from_bytes(payload[offset:offset + 2], 'big')
+            offset += 2
+            if len(payload) < offset + size:
+                raise ValueError("truncated bets payload")
+            fields.append(payload[offset:offset + size].decode('utf-8'))
+            offset += size
+        bets.append(Bet(str(agency), fields[0], fields[1], str(document), fields[2], str(number)))
+    if offset != len(payload):
+        raise ValueError(f"unexpected {len(payload) - offset} trailing bytes in bets payload")
+    return (seq if seq > 0 else None), bets
+
+"""
+Returns the binary frame of the message, see decode_frame for the format.
+The agency of a RESPONSE is only set in multiplexed connections.
+"""
+def encode_frame(message: Message) -> bytes:
+    if message.kind == BETS:
+        payload = (message.seq or 0).to_bytes(4, 'big') + len(message.bets).to_bytes(2, 'big')
+        for bet in message.bets:
+            payload += bet.number.to_bytes(4, 'big') + int(bet.document).to_bytes(4, 'big')
+            for field in (bet.first_name, bet.last_name, bet.birthdate.isoformat()):
+                field = field.encode('utf-8')
+                payload += len(field).to_bytes(2, 'big') + field
+    elif message.kind in (AWAIT_RESULTS, PING, SUBSCRIBE):
+        payload = b""
+    elif message.kind == RESPONSE:
+        payload = message.text.encode('utf-8')
+    elif message.kind == COMPRESSED:
+        payload = message.payload
+    else:
+        raise ValueError(f"unknown message type: {message.kind}")
+    if len(payload) > MAX_PAYLOAD_SIZE:
+        raise ValueError(f"payload too large: {len(payload)} bytes")
+    return bytes([message.kind]) + len(payload).to_bytes(4, 'big') + message.agency.to_bytes(4, 'big') + payload
+
+""" Size of a nonce: the time it was sent in unix nanoseconds (8 bytes) and random bytes (8 bytes). """
+NONCE_SIZE = 16
+""" Size of an HMAC-SHA256. """
+MAC_SIZE = 32
+
+""" Codes of the authentication errors. """
+AUTH_UNKNOWN_AGENCY = "unknown_agency"
+AUTH_BAD_SIGNATURE = "bad_signature"
+AUTH_EXPIRED_NONCE = "expired_nonce"
+AUTH_REPLAYED_NONCE = "replayed_nonce"
+
+""" Raised for a message of an agency that could not be authenticated. """
+class AuthError(ValueError):
+    def __init__(self, agency: int, code: str):
+        super().__init__(f"message of agency {agency} not authenticated: {code}")
+        self.agency = agency
+        self.code = code
+
+    def reply(self) -> str:
+        return f"ERROR: Mensaje no autenticado | Code:{self.code}"
+
+"""
+Parses a signed message to its agency, nonce, HMAC and signed payload, None if it is not signed.
+The signed payload is the line of the original message.
+Example of string: "[CLIENT 1] Signed Nonce:<hex> | HMAC:<hex> -> [CLIENT 1] Awaiting results"
+"""
+def parse_signed(msg: str):
+    header, _, line = msg.partition(" -> ")
+    tag, signed, fields = header.partition("] Signed ")
+    if not signed or not tag.startswith("[CLIENT "):
+        return None
+    fields = dict([pair.split(":", 1) for pair in fields.split(" | ")])
+    return int(tag[len("[CLIENT "):]), bytes.fromhex(fields["Nonce"]), bytes.fromhex(fields["HMAC"]), f"{line}\n".encode('utf-8')
+
+"""
+Parses a SIGNED frame to its agency, nonce, HMAC and signed payload, None if it is not signed.
+The payload of SIGNED is the nonce (16 bytes), the HMAC (32 bytes) and the signed frame.
+"""
+def parse_signed_frame(frame: bytes):
+    if frame[0] != SIGNED:
+        return None
+    payload = frame[BINARY_HEADER_SIZE:]
+    if len(payload) < NONCE_SIZE + MAC_SIZE:
+        raise ValueError("truncated signed payload")
+    return int.from_bytes(frame[5:9], 'big'), payload[:NONCE_SIZE], payload[NONCE_SIZE:NONCE_SIZE + MAC_SIZE], payload[NONCE_SIZE + MAC_SIZE:]
+
+"""
+Returns the HMAC-SHA256 of the agency (4 bytes, big endian), the nonce and the payload.
+"""
+def sign(secret: bytes, agency: int, nonce: bytes, payload: bytes) -> bytes:
+    return hmac.new(secret, agency.to_bytes(4, 'big') + nonce + payload, hashlib.sha256).digest()
+
+"""
+Checks the signature of a signed payload with the secret of its agency and returns
+the time its nonce was sent, in unix nanoseconds. The nonce must still be checked
+against the ones already seen.
+"""
+def verify_signature(secrets: dict[int, bytes], agency: int, nonce: bytes, mac: bytes, payload: bytes) -> int:
+    secret = secrets.get(agency)
+    if secret is None:
+        raise AuthError(agency, AUTH_UNKNOWN_AGENCY)
+    if len(nonce) != NONCE_SIZE or not hmac.compare_digest(mac, sign(secret, agency, nonce, payload)):
+        raise AuthError(agency, AUTH_BAD_SIGNATURE)
+    return int.from_bytes(nonce[:8], 'big')
+
+"""
+Parses the secrets of the agencies.
+Example of string: "1:secret1,2:secret2"
+"""
+def parse_secrets(secrets_str: str) -> dict[int, bytes]:
+    secrets = {}
+    for pair in secrets_str.split(","):
+        if pair.strip():
+            agency, secret = pair.split(":", 1)
+            secrets[int(agency)] = secret.encode('utf-8')
+    return secrets
@@ -2,6 +2,7 @@
 
 from configparser import ConfigParser
 from common.server_manager import ServerManager
+from common.utils import parse_secrets
 import logging
 import os
 
@@ -27,6 +28,8 @@ def initialize_config():
         config_params["listen_backlog"] = int(os.getenv('SERVER_LISTEN_BACKLOG', config["DEFAULT"]["SERVER_LISTEN_BACKLOG"]))
         config_params["logging_level"] = os.getenv('LOGGING_LEVEL', config["DEFAULT"]["LOGGING_LEVEL"])
         config_params["n_agencies"] = int(os.getenv('N_AGENCIES', config["DEFAULT"]["N_AGENCIES"]))
+        config_params["auth_secrets"] = parse_secrets(os.getenv('AUTH_SECRETS', config["DEFAULT"]["AUTH_SECRETS"]))
+        config_params["auth_max_age"] = int(os.getenv('AUTH_MAX_AGE', config["DEFAULT"]["AUTH_MAX_AGE"]))
     except KeyError as e:
         raise KeyError("Key was not found. Error: {} .Aborting server".format(e))
     except ValueError as e:
@@ -59,10 +62,12 @@ def main():
     # Log config parameters at the beginning of the program to verify the configuration
     # of the component
     logging.debug(f"action: config | result: success | port: {port} | "
-                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level}")
+                  f"listen_backlog: {listen_backlog} | logging_level: {logging_level} | "
+                  f"auth_agencies: {sorted(config_params['auth_secrets'])} | auth_max_age: {config_params['auth_max_age']}")
 
     # Initialize server manager and start server loop
-    server_manager = ServerManager(port, listen_backlog, config_params["n_agencies"])
+    server_manager = ServerManager(port, listen_backlog, config_params["n_agencies"],
+                                   config_params["auth_secrets"], config_params["auth_max_age"])
     server_manager.run()
 
 
@@ -46,6 +46,157 @@ class TestUtils(unittest.TestCase):
         self._assert_equal_bets(to_store[0], from_load[0])
         self._assert_equal_bets(to_store[1], from_load[1])
 
+    def test_decode_frame_matches_client_encoding(self):
+        # Same frame as TestBinaryCodecGolden of the protocol package
+        frame = bytes.fromhex("0100000024000000010000000100010000000701d790910003416e61000350617a000a313939392d30332d3137")
+        message = decode_frame(frame)
+
+        self.assertEqual(BETS, message.kind)
+        self.assertEqual(1, message.agency)
+        self.assertEqual(1, message.seq)
+        self._assert_equal_bets(Bet('1', 'Ana', 'Paz', '30904465', '1999-03-17', '7'), message.bets[0])
+        self.assertEqual(frame, encode_frame(message))
+
+    def test_frame_round_trip(self):
+        bets = [Bet('2', 'José\n', 'Núñez]', '10000000', '2000-12-20', '7574'),
+                Bet('2', 'first', 'last', '20000000', '1990-01-01', '1')]
+        messages = [Message(BETS, 2, seq=None, bets=bets),
+                    Message(AWAIT_RESULTS, 2),
+                    Message(PING, 2),
+                    Message(SUBSCRIBE, 2),
+                    Message(RESPONSE, 0, text="OK: Apuestas recibidas | Cantidad:2"),
+                    Message(RESPONSE, 3, text="PONG"),
+                    Message(COMPRESSED, 2, payload=b"\x1f\x8b")]
+
+        for message in messages:
+            frame = encode_frame(message)
+            decoded = decode_frame(frame)
+            self.assertEqual(len(frame), frame_length(frame + b"next"))
+            self.assertEqual(message.kind, decoded.kind)
+            self.assertEqual(message.agency, decoded.agency)
+            self.assertEqual(message.seq, decoded.seq)
+            self.assertEqual(message.text, decoded.text)
+            self.assertEqual(message.payload, decoded.payload)
+            self.assertEqual(len(message.bets), len(decoded.bets))
+            for expected, bet in zip(message.bets, decoded.bets):
+                self._assert_equal_bets(expected, bet)
+
+    def test_decode_frame_rejects_malformed_frames(self):
+        frame = encode_frame(Message(BETS, 1, seq=3, bets=[Bet('1', 'first', 'last', '1', '2000-12-20', '1')]))
+
+        self.assertIsNone(frame_length(frame[:BINARY_HEADER_SIZE - 1]))
+        with self.assertRaises(ValueError):
+            decode_frame(frame[:-1])
+        with self.assertRaises(ValueError):
+            decode_frame(frame[:1] + (len(frame) - BINARY_HEADER_SIZE - 3).to_bytes(4, 'big') + frame[5:-3])
+        with self.assertRaises(UnknownMessage):
+            decode_frame(bytes([99]) + frame[1:])
+
+    def test_parse_bets_unescapes_reserved_characters(self):
+        bets = parse_bets("[CLIENT 1] Bets -> [AgencyID:1,ID:7574,Name:Ana%2C María,Surname:O%3AB%5Bc%5D%25,PersonalID:10000000,BirthDate:2000-12-20]")
+
+        self.assertEqual(1, len(bets))
+        self.assertEqual('Ana, María', bets[0].first_name)
+        self.assertEqual('O:B[c]%', bets[0].last_name)
+        self.assertEqual(7574, bets[0].number)
+
+    def test_parse_seq_of_numbered_bets(self):
+        msg = "[CLIENT 1] Bets Seq:3 -> [AgencyID:1,ID:7574,Name:first,Surname:last,PersonalID:10000000,BirthDate:2000-12-20]"
+
+        self.assertEqual(3, parse_seq(msg))
+        self.assertEqual(1, len(parse_bets(msg)))
+
+    def test_parse_seq_of_unnumbered_bets(self):
+        self.assertIsNone(parse_seq("[CLIENT 1] Bets -> [AgencyID:1,ID:7574,Name:first,Surname:last,PersonalID:10000000,BirthDate:2000-12-20]"))
+
+    def test_decompress_message_returns_original_line(self):
+        line = "[CLIENT 1] Bets -> [AgencyID:1,ID:7574,Name:first,Surname:last,PersonalID:10000000,BirthDate:2000-12-20]"
+        payload = base64.b64encode(gzip.compress(f"{line}\n".encode('utf-8'))).decode('ascii')
+        msg = f"[CLIENT 1] Gzip -> {payload}"
+
+        self.assertEqual(COMPRESSED, parse_message(msg).kind)
+        self.assertEqual(line, decompress_message(msg))
+
+    def test_parse_message_dispatches_on_header(self):
+        self.assertEqual(PING, parse_message("[CLIENT 1] Ping").kind)
+        self.assertEqual(AWAIT_RESULTS, parse_message("[CLIENT 2] Awaiting results").kind)
+        self.assertEqual(2, parse_message("[CLIENT 2] Awaiting results").agency)
+        self.assertEqual(SUBSCRIBE, parse_message("[CLIENT 1] Subscribe results").kind)
+        self.assertEqual(HELLO, parse_message("[CLIENT 1] Hello -> Versions:1 | Features:").kind)
+
+    def test_parse_message_ignores_headers_inside_bets(self):
+        msg = parse_message("[CLIENT 1] Bets Seq:2 -> [AgencyID:1,ID:1,Name:Hello -> Ping,Surname:Awaiting results,PersonalID:1,BirthDate:2000-12-20]")
+
+        self.assertEqual(BETS, msg.kind)
+        self.assertEqual(2, msg.seq)
+        self.assertEqual("Hello -> Ping", msg.bets[0].first_name)
+
+    def test_parse_message_rejects_unknown_header(self):
+        with self.assertRaises(UnknownMessage):
+            parse_message("[CLIENT 1] Goodbye")
+        with self.assertRaises(ValueError):
+            parse_message("Bets -> [AgencyID:1]")
+
+    def test_parse_hello_keeps_versions_and_features(self):
+        versions, features = parse_hello("[CLIENT 1] Hello -> Versions:1,2 | Features:binary")
+
+        self.assertEqual({1, 2}, versions)
+        self.assertEqual({'binary'}, features)
+
+    def test_parse_hello_without_features(self):
+        versions, features = parse_hello("[CLIENT 1] Hello -> Versions:1 | Features:")
+
+        self.assertEqual({1}, versions)
+        self.assertEqual(set(), features)
+
+    def test_parse_signed_line(self):
+        line = "[CLIENT 1] Signed Nonce:000102030405060708090a0b0c0d0e0f | HMAC:4913270f87eefa689b4fde36c52e89767d0878d0127bbf9bc08828e09309b7f7 -> [CLIENT 1] Awaiting results"
+        agency, nonce, mac, payload = parse_signed(line)
+
+        self.assertEqual(1, agency)
+        self.assertEqual(b"[CLIENT 1] Awaiting results\n", payload)
+        self.assertEqual(0x0001020304050607, verify_signature({1: b"secret"}, agency, nonce, mac, payload))
+        self.assertIsNone(parse_signed("[CLIENT 1] Awaiting results"))
+
+    def test_parse_signed_frame(self):
+        nonce = bytes(range(16))
+        inner = bytes([AWAIT_RESULTS]) + (0).to_bytes(4, 'big') + (1).to_bytes(4, 'big')
+        mac = sign(b"secret", 1, nonce, inner)
+        frame = bytes([SIGNED]) + (len(inner) + 48).to_bytes(4, 'big') + (1).to_bytes(4, 'big') + nonce + mac + inner
+
+        self.assertEqual((1, nonce, mac, inner), parse_signed_frame(frame))
+        self.assertIsNone(parse_signed_frame(inner))
+        with self.assertRaises(ValueError):
+            parse_signed_frame(frame[:BINARY_HEADER_SIZE + 40])
+
+    def test_verify_signature_rejections(self):
+        nonce = bytes(range(16))
+        payload = b"[CLIENT 1] Ping\n"
+        mac = sign(b"secret", 1, nonce, payload)
+        verify_signature({1: b"secret"}, 1, nonce, mac, payload)
+
+        cases = [
+            (AUTH_UNKNOWN_AGENCY, {2: b"secret"}, mac),
+            (AUTH_BAD_SIGNATURE, {1: b"other"}, mac),
+            (AUTH_BAD_SIGNATURE, {1: b"secret"}, bytes([mac[0] ^ 0xFF]) + mac[1:]),
+        ]
+        for code, secrets, signature in cases:
+            with self.assertRaises(AuthError) as raised:
+                verify_signature(secrets, 1, nonce, signature, payload)
+            self.assertEqual(code, raised.exception.code)
+
+    def test_chunk_digest_tells_chunks_apart(self):
+        bet1 = Bet('1', 'first', 'last', '10000000', '2000-12-20', '7574')
+        bet2 = Bet('1', 'first', 'last', '10000001', '2000-12-20', '7574')
+
+        self.assertEqual(chunk_digest([bet1, bet2]), chunk_digest([Bet('1', 'first', 'last', '10000000', '2000-12-20', '7574'), bet2]))
+        self.assertNotEqual(chunk_digest([bet1, bet2]), chunk_digest([bet2, bet1]))
+        self.assertNotEqual(chunk_digest([bet1]), chunk_digest([bet1, bet2]))
+
+    def test_parse_secrets(self):
+        self.assertEqual({1: b"s1", 2: b"s:2"}, parse_secrets("1:s1,2:s:2"))
+        self.assertEqual({}, parse_secrets(""))
+
     def _assert_equal_bets(self, b1, b2):
         self.assertEqual(b1.agency, b2.agency)
         self.assertEqual(b1.first_name, b2.first_name)